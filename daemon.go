@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/RMBeristain/organise-downloads/internal/common"
+	"github.com/RMBeristain/organise-downloads/internal/lock"
+	"github.com/RMBeristain/organise-downloads/internal/logging"
+	"github.com/RMBeristain/organise-downloads/internal/retry"
+	"github.com/RMBeristain/organise-downloads/organiser"
+)
+
+// lockPollInterval is how long whileLocked waits for the lock before checking whether it should give up.
+const lockPollInterval = time.Second
+
+// getRetryQueuePath returns the path of the daemon's retry queue in the state dir.
+func getRetryQueuePath() (string, error) {
+	stateDir, err := common.GetStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, retry.FileName), nil
+}
+
+// loadRetryQueue reads the retry queue from the state dir, or starts an empty one if it can't be read.
+func loadRetryQueue(logger logging.Zerologger) *retry.Queue {
+	queuePath, err := getRetryQueuePath()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("unable to find state dir")
+	}
+	queue, err := retry.Load(queuePath)
+	if err != nil {
+		logger.Warn().Err(err).Str("path", queuePath).Msg("unable to read retry queue; starting with an empty one")
+		queue = retry.New(queuePath)
+	}
+	return queue
+}
+
+// saveRetryQueue writes the retry queue back to the state dir.
+func saveRetryQueue(logger logging.Zerologger, queue *retry.Queue) {
+	if err := queue.Save(); err != nil {
+		logger.Err(err).Msg("unable to save retry queue")
+	}
+}
+
+// runDaemon organises the downloads dir every interval until it receives SIGINT or SIGTERM. Files that are in use, or
+// that fail to move, are retried with exponential backoff in between, and the queue of retries is kept in the state dir
+// so it survives restarts. The lock is only held while files are being moved, so other commands, such as undo, can run
+// in between.
+func runDaemon(args []string) {
+	flagSet := flag.NewFlagSet("daemon", flag.ExitOnError)
+	options := addCommonFlags(flagSet)
+	pEvery := flagSet.Duration("every", 20*time.Minute, "Scan the downloads dir this often")
+	flagSet.Parse(args)
+
+	logger := initLogger(options)
+	if *pEvery <= 0 {
+		fmt.Fprintln(flagSet.Output(), "-every must be positive")
+		flagSet.Usage()
+		os.Exit(2)
+	}
+	workingSrcDir := getWorkingSrcDir(logger, options)
+	downloads := newOrganiser(logger, options, workingSrcDir)
+	defer acquireSessionLock(logger, options)()
+
+	queue := loadRetryQueue(logger)
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	logger.Info().Str("downloadDir", workingSrcDir).Dur("every", *pEvery).Int("retryCount", len(queue.Items())).
+		Msg("DAEMON STARTED.")
+	nextCycle := time.Now()
+	for {
+		if !time.Now().Before(nextCycle) {
+			nextCycle = time.Now().Add(*pEvery)
+			whileLocked(ctx, logger, func() { runCycle(ctx, logger, workingSrcDir, downloads, queue) })
+		} else {
+			whileLocked(ctx, logger, func() { retryDue(ctx, logger, downloads, queue) })
+		}
+		saveRetryQueue(logger, queue)
+
+		wakeUp := nextCycle
+		if nextTry, ok := queue.NextTry(); ok && nextTry.Before(wakeUp) {
+			wakeUp = nextTry
+		}
+		timer := time.NewTimer(time.Until(wakeUp))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			logger.Info().Int("retryCount", len(queue.Items())).Msg("DAEMON STOPPED.")
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// whileLocked runs pass while holding the lock that one-off commands take, waiting for as long as another instance
+// holds it. pass is skipped if ctx is done first, or the lock can't be taken.
+func whileLocked(ctx context.Context, logger logging.Zerologger, pass func()) {
+	stateDir, err := common.GetStateDir()
+	if err != nil {
+		logger.Err(err).Msg("unable to find state dir; skipping this pass")
+		return
+	}
+	path := filepath.Join(stateDir, lock.FileName)
+	var instanceLock *lock.Lock
+	for logged := false; instanceLock == nil; logged = true {
+		if ctx.Err() != nil {
+			return
+		}
+		instanceLock, err = lock.Acquire(path, lockPollInterval)
+		if errors.Is(err, lock.ErrLocked) {
+			if !logged {
+				logger.Info().Err(err).Msg("waiting for another instance to finish")
+			}
+		} else if err != nil {
+			logger.Err(err).Msg("unable to lock state dir; skipping this pass")
+			return
+		}
+	}
+	defer releaseFunc(logger, instanceLock)()
+	pass()
+}
+
+// runCycle organises every file in the downloads dir, except those waiting for a retry that isn't due yet. Files that
+// can't be moved yet are queued, and queued files that are gone are forgotten.
+func runCycle(
+	ctx context.Context, logger logging.Zerologger, workingSrcDir string, downloads *organiser.Organiser,
+	queue *retry.Queue,
+) {
+	startTime := time.Now()
+	waiting := make(map[string]bool) // a copy, as the queue changes while files are still being listed
+	for _, item := range queue.Items() {
+		if _, err := os.Lstat(filepath.Join(workingSrcDir, item.File)); errors.Is(err, fs.ErrNotExist) {
+			queue.Succeeded(item.File) // moved or deleted by someone else
+		} else if queue.Waiting(item.File, startTime) {
+			waiting[item.File] = true
+		}
+	}
+
+	report, err := downloads.OrganiseExcept(ctx, func(fileName string) bool { return waiting[fileName] },
+		func(result organiser.MoveResult) { queueResult(logger, queue, result) })
+	if err != nil && ctx.Err() == nil {
+		logger.Err(err).Msg("unable to organise downloads dir")
+	}
+	queueDeferred(logger, queue, report.Deferred)
+	logger.Info().Dur("elapsedTime", time.Since(startTime)).Msg("CYCLE DONE.")
+}
+
+// retryDue tries to move the queued files whose next attempt is due.
+func retryDue(ctx context.Context, logger logging.Zerologger, downloads *organiser.Organiser, queue *retry.Queue) {
+	var files []fs.DirEntry
+	seen := make(map[string]bool)
+	for _, fileName := range queue.Due(time.Now()) {
+		entries, err := downloads.Entries(fileName)
+		if err != nil {
+			queue.Succeeded(fileName) // gone; if it's still there, the next cycle will find it
+			continue
+		}
+		for _, entry := range entries {
+			if !seen[entry.Name()] {
+				seen[entry.Name()] = true
+				files = append(files, entry)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+	moveWithRetries(ctx, logger, downloads, files, queue)
+}
+
+// moveWithRetries moves files, queueing the ones that can't be moved yet and removing the rest from the queue. Files
+// that may still be being written are tried again once they're old enough, or with backoff if there's no telling when.
+// Files that aren't moved for other reasons, such as being excluded, are left to the next cycle.
+func moveWithRetries(
+	ctx context.Context, logger logging.Zerologger, downloads *organiser.Organiser, files []fs.DirEntry,
+	queue *retry.Queue,
+) {
+	movePlan, err := downloads.PlanFiles(ctx, files)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Err(err).Msg("unable to plan moves")
+		}
+		return
+	}
+
+	waiting := make(map[string]bool)
+	for _, this := range movePlan.Deferred {
+		waiting[this.File] = true
+	}
+	queueDeferred(logger, queue, movePlan.Deferred)
+
+	// An interrupted Apply still reports the files it got to.
+	report, err := downloads.Apply(ctx, movePlan)
+	if err != nil && ctx.Err() == nil {
+		logger.Err(err).Msg("unable to move files")
+		return
+	}
+	for _, result := range report.Results {
+		if result.Retryable() {
+			waiting[result.File()] = true
+		}
+		queueResult(logger, queue, result)
+	}
+
+	for _, file := range files {
+		if !waiting[file.Name()] {
+			queue.Succeeded(file.Name())
+		}
+	}
+}
+
+// queueDeferred queues files that may still be being written, to be tried again once they're old enough, or with
+// backoff if there's no telling when.
+func queueDeferred(logger logging.Zerologger, queue *retry.Queue, deferred []organiser.Deferred) {
+	for _, this := range deferred {
+		var item retry.Item
+		if this.SettlesAt.IsZero() {
+			item = queue.Failed(this.File, errors.New(this.Reason), time.Now())
+		} else {
+			item = queue.Schedule(this.File, this.SettlesAt, this.Reason)
+		}
+		logger.Debug().Str("file", this.File).Time("nextTry", item.NextTry).Msg("will retry once settled")
+	}
+}
+
+// queueResult queues a file that couldn't be moved, and takes one that was dealt with out of the queue.
+func queueResult(logger logging.Zerologger, queue *retry.Queue, result organiser.MoveResult) {
+	if !result.Retryable() {
+		queue.Succeeded(result.File())
+		return
+	}
+	item := queue.Failed(result.File(), result.Err, time.Now())
+	logger.Info().Str("file", result.File()).Int("attempts", item.Attempts).Time("nextTry", item.NextTry).
+		Str("reason", item.LastError).Msg("will retry")
+}
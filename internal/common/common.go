@@ -2,28 +2,75 @@
 package common
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strings"
 
-	"github.com/RMBeristain/organise-downloads/internal/logging"
 	"github.com/pelletier/go-toml/v2"
 )
 
 // DefaultExcludedExtensions is the list of extensions to ignore by default
 var DefaultExcludedExtensions = []string{".DS_Store", ".localized", ".crdownload", ".part", ".tmp"}
 
-var logger = &logging.ConfiguredZerologger
+// DefaultPartialSuffixes are the suffixes browsers and download managers add to a download while it's in progress.
+var DefaultPartialSuffixes = []string{".part", ".crdownload", ".download", ".opdownload", ".!qB"}
+
+// DefaultMaxDepth is how many levels of subdirs a recursive run looks into, unless the TOML file says otherwise.
+const DefaultMaxDepth = 5
+
+// DefaultLogConfig holds the log settings that aren't in the TOML file.
+var DefaultLogConfig = LogConfig{Sink: "file", Format: "json", Caller: true, MaxSizeMB: 10, Keep: 5}
+
+// SampleCategories is written to the sample TOML file to show how several extensions can share one folder.
+var SampleCategories = map[string][]string{
+	"Images":    {".jpg", ".jpeg", ".png", ".webp"},
+	"Documents": {".pdf", ".docx"},
+}
+
+// Config holds every setting that can be read from the TOML file.
+type Config struct {
+	ExcludedFiles        []string            `toml:"excludedFiles"`
+	Categories           map[string][]string `toml:"categories"`
+	ContentDetection     string              `toml:"contentDetection,omitempty"`
+	OnConflict           string              `toml:"onConflict,omitempty"`
+	OnConflictByCategory map[string]string   `toml:"onConflictByCategory,omitempty"`
+	Dedupe               string              `toml:"dedupe,omitempty"`
+	VerifyCopyHash       bool                `toml:"verifyCopyHash,omitempty"`
+	MinAge               int                 `toml:"minAge,omitempty"`            // seconds
+	StabilityInterval    int                 `toml:"stabilityInterval,omitempty"` // seconds
+	PartialSuffixes      []string            `toml:"partialSuffixes,omitempty"`
+	Recursive            bool                `toml:"recursive,omitempty"`     // also move files out of subdirs
+	MaxDepth             int                 `toml:"maxDepth,omitempty"`      // how many levels of subdirs; 0 means DefaultMaxDepth
+	PreservePaths        bool                `toml:"preservePaths,omitempty"` // keep nested files' subdirs under their category
+	Log                  LogConfig           `toml:"log"`
+}
+
+// LogConfig controls where logs go, what they look like and how the log file is rotated. Zero limits turn them off.
+type LogConfig struct {
+	Sink       string `toml:"sink"`       // file, stderr or both
+	Path       string `toml:"path"`       // the log file; empty means organise-downloads.log in the state dir
+	Format     string `toml:"format"`     // json or pretty
+	Caller     bool   `toml:"caller"`     // whether entries record the file and line that logged them
+	MaxSizeMB  int    `toml:"maxSizeMB"`  // rotate before the file grows past this many megabytes
+	MaxAgeDays int    `toml:"maxAgeDays"` // rotate once the file has been written to for this many days
+	Keep       int    `toml:"keep"`       // rotated files to keep
+	Compress   bool   `toml:"compress"`   // gzip rotated files
+}
+
+// CategoryIndex maps a lower-case file extension to the name of the category folder it belongs in.
+type CategoryIndex map[string]string
 
 // GetCurrentUserDownloadPath finds the current user and their home directory. The return value is the address of a
 // string variable that stores the value of the fully-qualified path to 'Downloads' dir (e.g. /Users/me/Downloads).
 func GetCurrentUserDownloadPath(defaultSrcDir string) (string, error) {
-	currentUser, err := user.Current()
-	if err != nil {
+	if _, err := user.Current(); err != nil {
 		return "", err
 	}
 
@@ -31,40 +78,114 @@ func GetCurrentUserDownloadPath(defaultSrcDir string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	return filepath.Join(homeDir, defaultSrcDir), nil
+}
 
-	workingPath := filepath.Join(homeDir, defaultSrcDir)
-	logger.Debug().Str("workingPath", workingPath).Str("currentUser", currentUser.Username).Send()
-	return workingPath, nil
+// GetStateDir returns the dir where organise-downloads keeps its own files (journal, locks, queues), creating it if
+// needed. It follows the XDG base directory spec: $XDG_STATE_HOME/organise-downloads, or ~/.local/state/organise-downloads.
+func GetStateDir() (string, error) {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" || !filepath.IsAbs(stateHome) {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		stateHome = filepath.Join(homeDir, ".local", "state")
+	}
+
+	stateDir := filepath.Join(stateHome, "organise-downloads")
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return "", err
+	}
+	return stateDir, nil
 }
 
 // PathExists returns whether the given file or directory exists
 func PathExists(path string) (exists bool, err error) {
 	_, err = os.Stat(path)
 	if err == nil {
-		logger.Trace().Str("path", path).Msg("already exists")
 		return true, nil
 	}
 	if errors.Is(err, fs.ErrNotExist) {
-		logger.Trace().Str("path", path).Err(err).Msg("doesn't exist")
 		return false, nil
 	}
-	logger.Err(err).Msg("unexpected error")
 	return false, err
 }
 
+// ContextReader is an io.Reader that fails with Ctx's error once Ctx is done, so reading a large file can be
+// interrupted.
+type ContextReader struct {
+	Ctx    context.Context
+	Reader io.Reader
+}
+
+// Read reads from Reader, unless Ctx is done.
+func (reader ContextReader) Read(p []byte) (int, error) {
+	if err := reader.Ctx.Err(); err != nil {
+		return 0, err
+	}
+	return reader.Reader.Read(p)
+}
+
+// SameContents returns whether the files at pathA and pathB are byte-for-byte identical. If ctx is done part way
+// through, it returns ctx's error.
+func SameContents(ctx context.Context, pathA, pathB string) (bool, error) {
+	fileA, err := os.Open(pathA)
+	if err != nil {
+		return false, err
+	}
+	defer fileA.Close()
+	fileB, err := os.Open(pathB)
+	if err != nil {
+		return false, err
+	}
+	defer fileB.Close()
+
+	infoA, err := fileA.Stat()
+	if err != nil {
+		return false, err
+	}
+	infoB, err := fileB.Stat()
+	if err != nil {
+		return false, err
+	}
+	if infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+
+	bufferA := make([]byte, 64*1024)
+	bufferB := make([]byte, 64*1024)
+	readerA, readerB := ContextReader{ctx, fileA}, ContextReader{ctx, fileB}
+	for {
+		nA, errA := io.ReadFull(readerA, bufferA)
+		nB, errB := io.ReadFull(readerB, bufferB)
+		if !bytes.Equal(bufferA[:nA], bufferB[:nB]) {
+			return false, nil
+		}
+		doneA := errors.Is(errA, io.EOF) || errors.Is(errA, io.ErrUnexpectedEOF)
+		doneB := errors.Is(errB, io.EOF) || errors.Is(errB, io.ErrUnexpectedEOF)
+		if errA != nil && !doneA {
+			return false, errA
+		}
+		if errB != nil && !doneB {
+			return false, errB
+		}
+		if doneA || doneB {
+			return doneA == doneB, nil
+		}
+	}
+}
+
 // CreateDirIfNotExists returns true if dir was created, else false; if there is an error returns (false, err)
 func CreateDirIfNotExists(dirName string) (wasCreated bool, err error) {
 	if exists, err := PathExists(dirName); !exists && err == nil {
-		logger.Debug().Str("targetDir", dirName).Msg("attempting to create missing dir")
 		err = os.Mkdir(dirName, 0755)
 		if err != nil {
-			logger.Err(err).Str("targetDir", dirName).Msg("unable to create dir")
 			return false, err
 		}
 
 		return true, nil
 	} else if err != nil {
-		logger.Err(err).Msg("unable to create log dir")
 		return false, err
 	}
 
@@ -77,30 +198,81 @@ func GetExtAndSubdir(fileName string) (fileExtension, subDirName string) {
 	return fileExtension, strings.Replace(fileExtension, ".", "", 1) + "_files"
 }
 
-// LoadExcludedExtensions reads excluded extensions from a TOML file if path is provided, else returns defaults.
-func LoadExcludedExtensions(path string) ([]string, error) {
-	if path == "" {
-		return DefaultExcludedExtensions, nil
+// NewCategoryIndex inverts the categories read from TOML so each extension can be looked up directly.
+//
+// Extensions are matched case-insensitively and the leading dot is optional. An extension listed under two different
+// categories is an error, because there would be no way to tell which folder should win.
+func NewCategoryIndex(categories map[string][]string) (CategoryIndex, error) {
+	index := make(CategoryIndex)
+	for category, extensions := range categories {
+		if category == "" || strings.ContainsAny(category, `/\`) || category == "." || category == ".." {
+			return nil, fmt.Errorf("invalid category name %q", category)
+		}
+		for _, extension := range extensions {
+			extension = strings.ToLower(extension)
+			if !strings.HasPrefix(extension, ".") {
+				extension = "." + extension
+			}
+			if previous, ok := index[extension]; ok && previous != category {
+				return nil, fmt.Errorf("extension %q is listed in both %q and %q", extension, previous, category)
+			}
+			index[extension] = category
+		}
 	}
+	return index, nil
+}
 
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// GetExtAndSubdir returns a file's extension and the category folder it belongs in. Extensions without a category
+// fall back to the package-level GetExtAndSubdir, i.e. '<ext>_files'.
+func (index CategoryIndex) GetExtAndSubdir(fileName string) (fileExtension, subDirName string) {
+	fileExtension = filepath.Ext(fileName)
+	return fileExtension, index.Subdir(fileExtension)
+}
+
+// Subdir returns the folder that files with the given extension belong in.
+func (index CategoryIndex) Subdir(fileExtension string) string {
+	if category, ok := index[strings.ToLower(fileExtension)]; ok && fileExtension != "" {
+		return category
 	}
-	defer f.Close()
+	_, subDirName := GetExtAndSubdir(fileExtension)
+	return subDirName
+}
 
-	var config struct {
-		ExcludedFiles []string `toml:"excludedFiles"`
+// LoadConfig reads the TOML file at path. If path is empty, or the file doesn't set 'excludedFiles', the
+// DefaultExcludedExtensions are used.
+func LoadConfig(path string) (Config, error) {
+	config := Config{Log: DefaultLogConfig} // settings the file leaves out keep their defaults
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return Config{}, err
+		}
+		defer f.Close()
+
+		if err := toml.NewDecoder(f).Decode(&config); err != nil {
+			return Config{}, err
+		}
 	}
 
-	if err := toml.NewDecoder(f).Decode(&config); err != nil {
-		return nil, err
+	if config.ExcludedFiles == nil {
+		config.ExcludedFiles = DefaultExcludedExtensions
+	}
+	if config.PartialSuffixes == nil {
+		config.PartialSuffixes = DefaultPartialSuffixes
 	}
+	return config, nil
+}
 
+// LoadExcludedExtensions reads excluded extensions from a TOML file if path is provided, else returns defaults.
+func LoadExcludedExtensions(path string) ([]string, error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
 	return config.ExcludedFiles, nil
 }
 
-// GenerateSampleToml creates a default TOML file with the contents of DefaultExcludedExtensions.
+// GenerateSampleToml creates a default TOML file with the contents of DefaultExcludedExtensions and SampleCategories.
 func GenerateSampleToml(path string) error {
 	info, err := os.Stat(path)
 	if err == nil && info.IsDir() {
@@ -122,10 +294,12 @@ func GenerateSampleToml(path string) error {
 	}
 	defer f.Close()
 
-	config := struct {
-		ExcludedFiles []string `toml:"excludedFiles"`
-	}{
-		ExcludedFiles: DefaultExcludedExtensions,
+	config := Config{
+		ExcludedFiles:   DefaultExcludedExtensions,
+		Categories:      SampleCategories,
+		OnConflict:      "skip",
+		PartialSuffixes: DefaultPartialSuffixes,
+		Log:             DefaultLogConfig,
 	}
 
 	return toml.NewEncoder(f).Encode(config)
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -64,6 +65,39 @@ func TestGetCurrentUserDownloadPath(t *testing.T) {
 	})
 }
 
+func TestGetStateDir(t *testing.T) {
+	t.Run("XDG_STATE_HOME is set", func(t *testing.T) {
+		stateHome := t.TempDir()
+		t.Setenv("XDG_STATE_HOME", stateHome)
+
+		stateDir, err := GetStateDir()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if stateDir != filepath.Join(stateHome, "organise-downloads") {
+			t.Errorf("Expected state dir under %s, got %s", stateHome, stateDir)
+		}
+		if info, err := os.Stat(stateDir); err != nil || !info.IsDir() {
+			t.Errorf("Expected state dir to be created, got %v", err)
+		}
+	})
+
+	t.Run("Relative XDG_STATE_HOME is ignored", func(t *testing.T) {
+		homeDir := t.TempDir()
+		t.Setenv("HOME", homeDir)
+		t.Setenv("USERPROFILE", homeDir) // Windows
+		t.Setenv("XDG_STATE_HOME", "relative/path")
+
+		stateDir, err := GetStateDir()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if stateDir != filepath.Join(homeDir, ".local", "state", "organise-downloads") {
+			t.Errorf("Expected default state dir, got %s", stateDir)
+		}
+	})
+}
+
 func TestCreateDirIfNotExists(t *testing.T) {
 	tempDir := t.TempDir()
 
@@ -315,3 +349,153 @@ func TestLoadExcludedExtensions(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("Categories and defaults", func(t *testing.T) {
+		content := `[categories]
+Images = [".jpg", ".jpeg", ".png", ".webp"]
+Documents = [".pdf", ".docx"]
+`
+		path := filepath.Join(t.TempDir(), "config.toml")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write test file: %v", err)
+		}
+
+		config, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(config.ExcludedFiles, DefaultExcludedExtensions) {
+			t.Errorf("expected default excluded files, got %v", config.ExcludedFiles)
+		}
+		if !reflect.DeepEqual(config.PartialSuffixes, DefaultPartialSuffixes) {
+			t.Errorf("expected default partial suffixes, got %v", config.PartialSuffixes)
+		}
+		if config.Log != DefaultLogConfig {
+			t.Errorf("expected default log settings, got %+v", config.Log)
+		}
+		if len(config.Categories["Images"]) != 4 || len(config.Categories["Documents"]) != 2 {
+			t.Errorf("unexpected categories %v", config.Categories)
+		}
+	})
+
+	t.Run("Explicitly empty exclusions", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.toml")
+		if err := os.WriteFile(path, []byte("excludedFiles = []\n"), 0644); err != nil {
+			t.Fatalf("unable to write test file: %v", err)
+		}
+
+		config, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(config.ExcludedFiles) != 0 {
+			t.Errorf("expected no excluded files, got %v", config.ExcludedFiles)
+		}
+	})
+
+	t.Run("Log rotation", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.toml")
+		if err := os.WriteFile(path, []byte("[log]\nmaxAgeDays = 30\ncompress = true\n"), 0644); err != nil {
+			t.Fatalf("unable to write test file: %v", err)
+		}
+
+		config, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := DefaultLogConfig // settings left out keep their defaults
+		expected.MaxAgeDays, expected.Compress = 30, true
+		if config.Log != expected {
+			t.Errorf("expected %+v, got %+v", expected, config.Log)
+		}
+	})
+}
+
+func TestCategoryIndex(t *testing.T) {
+	index, err := NewCategoryIndex(map[string][]string{
+		"Images":    {".jpg", "PNG"},
+		"Documents": {".pdf"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	testCases := []struct {
+		input     string
+		extension string
+		subfolder string
+	}{
+		{"photo.jpg", ".jpg", "Images"},
+		{"photo.JPG", ".JPG", "Images"},
+		{"scan.png", ".png", "Images"},
+		{"report.pdf", ".pdf", "Documents"},
+		{"notes.txt", ".txt", "txt_files"},
+		{"noext", "", "_files"},
+	}
+	for _, this := range testCases {
+		extension, subdir := index.GetExtAndSubdir(this.input)
+		if extension != this.extension {
+			t.Errorf("Returned extension '%v' doesn't match expected '%v'", extension, this.extension)
+		}
+		if subdir != this.subfolder {
+			t.Errorf("Returned subdir '%v' doesn't match expected '%v'", subdir, this.subfolder)
+		}
+	}
+
+	t.Run("Extension in two categories", func(t *testing.T) {
+		_, err := NewCategoryIndex(map[string][]string{"A": {".jpg"}, "B": {".JPG"}})
+		if err == nil {
+			t.Error("expected error for duplicated extension, got nil")
+		}
+	})
+
+	t.Run("Category that isn't a plain folder name", func(t *testing.T) {
+		_, err := NewCategoryIndex(map[string][]string{"../Images": {".jpg"}})
+		if err == nil {
+			t.Error("expected error for invalid category name, got nil")
+		}
+	})
+}
+
+func TestSameContents(t *testing.T) {
+	tempDir := t.TempDir()
+	large := make([]byte, 200*1024) // spans several reads
+	files := map[string][]byte{
+		"a":      []byte("same content"),
+		"b":      []byte("same content"),
+		"c":      []byte("other stuff!"),
+		"short":  []byte("same"),
+		"large1": large,
+		"large2": append(append([]byte(nil), large[:len(large)-1]...), 1),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tempDir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		pathA, pathB string
+		expected     bool
+	}{
+		{"a", "b", true},
+		{"a", "c", false},
+		{"a", "short", false},
+		{"large1", "large1", true},
+		{"large1", "large2", false},
+	}
+	for _, tc := range tests {
+		same, err := SameContents(context.Background(), filepath.Join(tempDir, tc.pathA), filepath.Join(tempDir, tc.pathB))
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if same != tc.expected {
+			t.Errorf("Expected SameContents(%s, %s)=%v, got %v", tc.pathA, tc.pathB, tc.expected, same)
+		}
+	}
+
+	if _, err := SameContents(context.Background(), filepath.Join(tempDir, "a"), filepath.Join(tempDir, "missing")); err == nil {
+		t.Error("Expected error for missing file, got nil")
+	}
+}
@@ -0,0 +1,319 @@
+// Content-hash duplicate detection
+package dedupe
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/RMBeristain/organise-downloads/internal/common"
+)
+
+// Action is what happens to the duplicates that are found.
+type Action string
+
+const (
+	ActionOff      Action = "off"      // don't look for duplicates
+	ActionReport   Action = "report"   // only report them; they stay where they are and aren't moved
+	ActionTrash    Action = "trash"    // move them into TrashDirName
+	ActionHardlink Action = "hardlink" // replace them with a hard link to the copy that's kept
+)
+
+// TrashDirName is the dir, inside the downloads dir, where ActionTrash puts duplicates. It doesn't end in '_files', so
+// it's never scanned for duplicates itself.
+const TrashDirName = "duplicates_trash"
+
+// Group is a set of files with identical contents. Keep is the copy that stays; the rest are Duplicates.
+type Group struct {
+	Size       int64
+	Hash       string
+	Keep       string
+	Duplicates []string
+}
+
+// Result says what happened to one duplicate when an action was applied.
+type Result struct {
+	Path string
+	Keep string
+	Err  error
+}
+
+// ParseAction converts a value read from TOML or the command line into an Action. An empty value means ActionOff.
+func ParseAction(value string) (Action, error) {
+	switch action := Action(value); action {
+	case "":
+		return ActionOff, nil
+	case ActionOff, ActionReport, ActionTrash, ActionHardlink:
+		return action, nil
+	}
+	return "", fmt.Errorf("unknown dedupe action %q (expected %q, %q, %q or %q)",
+		value, ActionOff, ActionReport, ActionTrash, ActionHardlink)
+}
+
+// Scan looks for identical files among rootFiles (files inside rootDir, named by their paths relative to it) and the
+// files in subDirs. The kept copy of each group is one that's already inside a subdir if possible, then the one with
+// the shortest name, so 'file.pdf' is kept over 'file (1).pdf'.
+//
+// Files that can't be read are left out, and their errors are returned joined together alongside the groups found. If
+// ctx is done, the files being hashed are abandoned and only ctx's error is returned.
+func Scan(ctx context.Context, rootDir string, rootFiles []string, subDirs []string, workers int) ([]Group, error) {
+	var paths []string
+	for _, name := range rootFiles {
+		paths = append(paths, filepath.Join(rootDir, name))
+	}
+	organised := make(map[string]bool)
+	for _, subDir := range subDirs {
+		entries, err := os.ReadDir(subDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				path := filepath.Join(subDir, entry.Name())
+				paths = append(paths, path)
+				organised[path] = true
+			}
+		}
+	}
+
+	identicalSets, err := findIdentical(ctx, paths, workers)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	groups := make([]Group, 0, len(identicalSets))
+	for _, set := range identicalSets {
+		sort.Slice(set.paths, func(i, j int) bool {
+			return keepFirst(organised, set.paths[i], set.paths[j])
+		})
+		groups = append(groups, Group{Size: set.size, Hash: set.hash, Keep: set.paths[0], Duplicates: set.paths[1:]})
+	}
+	return groups, err
+}
+
+// DuplicatesIn maps every duplicate inside dir, named by its path relative to dir, to the path of the copy that's kept.
+func DuplicatesIn(groups []Group, dir string) map[string]string {
+	duplicates := make(map[string]string)
+	for _, group := range groups {
+		for _, path := range group.Duplicates {
+			if relPath, err := filepath.Rel(dir, path); err == nil && filepath.IsLocal(relPath) {
+				duplicates[relPath] = group.Keep
+			}
+		}
+	}
+	return duplicates
+}
+
+// Apply carries out action on every duplicate in groups. Before touching a duplicate its contents are compared with
+// the kept copy again, in case either changed since they were hashed. If ctx is done, Apply stops before the next
+// duplicate, and returns what it did so far.
+func Apply(ctx context.Context, groups []Group, action Action, trashDir string) []Result {
+	if action != ActionTrash && action != ActionHardlink {
+		return nil
+	}
+
+	var results []Result
+	for _, group := range groups {
+		for _, path := range group.Duplicates {
+			if ctx.Err() != nil {
+				return results
+			}
+			result := Result{Path: path, Keep: group.Keep}
+			identical, err := common.SameContents(ctx, group.Keep, path)
+			if ctx.Err() != nil {
+				return results // the comparison was cut short, so the duplicate is left alone
+			}
+			if err == nil && !identical {
+				err = errors.New("no longer identical to the kept copy")
+			}
+			if err == nil {
+				if action == ActionTrash {
+					err = moveToTrash(path, trashDir)
+				} else {
+					err = replaceWithHardlink(group.Keep, path)
+				}
+			}
+			result.Err = err
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// keepFirst orders the copies in a group so the one to keep comes first. organised holds the paths that are already
+// inside a subdir.
+func keepFirst(organised map[string]bool, pathA, pathB string) bool {
+	if organised[pathA] != organised[pathB] {
+		return organised[pathA]
+	}
+	nameA, nameB := filepath.Base(pathA), filepath.Base(pathB)
+	if len(nameA) != len(nameB) {
+		return len(nameA) < len(nameB)
+	}
+	return pathA < pathB
+}
+
+// identicalSet is a set of paths whose contents have the same size and hash.
+type identicalSet struct {
+	size  int64
+	hash  string
+	paths []string
+}
+
+// statResult is a path and what Lstat returned for it.
+type statResult struct {
+	path string
+	info os.FileInfo
+}
+
+// hashResult is what a hashing worker returns for one path.
+type hashResult struct {
+	path string
+	size int64
+	hash string
+	err  error
+}
+
+// findIdentical groups paths by content. Files are first grouped by size, and only files that share their size with
+// another file are hashed, by a pool of workers. Empty files, and paths that are hard links to a path seen earlier,
+// are ignored. Once ctx is done no more files are hashed, and those being hashed fail with ctx's error.
+func findIdentical(ctx context.Context, paths []string, workers int) ([]identicalSet, error) {
+	var errs []error
+	bySize := make(map[int64][]statResult)
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// Hard links share their size, so they only need to be looked for among files of the same size.
+		if !info.Mode().IsRegular() || info.Size() == 0 || isHardlinkOf(info, bySize[info.Size()]) {
+			continue
+		}
+		bySize[info.Size()] = append(bySize[info.Size()], statResult{path, info})
+	}
+
+	jobs := make(chan string)
+	results := make(chan hashResult)
+	go func() {
+		defer close(jobs)
+		for _, sameSize := range bySize {
+			if len(sameSize) < 2 {
+				continue // size pre-filter: a file with a unique size can't have a duplicate
+			}
+			for _, this := range sameSize {
+				select {
+				case jobs <- this.path:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				size, hash, err := hashFile(ctx, path)
+				results <- hashResult{path, size, hash, err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	byHash := make(map[string]*identicalSet)
+	for result := range results {
+		if result.err != nil {
+			errs = append(errs, result.err)
+			continue
+		}
+		key := fmt.Sprintf("%d:%s", result.size, result.hash)
+		if _, ok := byHash[key]; !ok {
+			byHash[key] = &identicalSet{size: result.size, hash: result.hash}
+		}
+		byHash[key].paths = append(byHash[key].paths, result.path)
+	}
+
+	var sets []identicalSet
+	for _, set := range byHash {
+		if len(set.paths) > 1 {
+			sets = append(sets, *set)
+		}
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].hash < sets[j].hash })
+	return sets, errors.Join(errs...)
+}
+
+// isHardlinkOf returns whether info is the same file as any of seen.
+func isHardlinkOf(info os.FileInfo, seen []statResult) bool {
+	for _, other := range seen {
+		if os.SameFile(info, other.info) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashFile returns the size and SHA-256 of the file at path, unless ctx is done first.
+func hashFile(ctx context.Context, path string) (size int64, hash string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	size, err = io.Copy(hasher, common.ContextReader{Ctx: ctx, Reader: f})
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// moveToTrash moves path into trashDir, adding a numbered suffix if the name is taken.
+func moveToTrash(path, trashDir string) error {
+	if err := os.MkdirAll(trashDir, 0755); err != nil {
+		return err
+	}
+
+	fileExtension := filepath.Ext(path)
+	baseName := strings.TrimSuffix(filepath.Base(path), fileExtension)
+	trashPath := filepath.Join(trashDir, filepath.Base(path))
+	for attempt := 2; ; attempt++ {
+		exists, err := common.PathExists(trashPath)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			break
+		}
+		trashPath = filepath.Join(trashDir, fmt.Sprintf("%s (%d)%s", baseName, attempt, fileExtension))
+	}
+	return os.Rename(path, trashPath)
+}
+
+// replaceWithHardlink atomically replaces path with a hard link to keep.
+func replaceWithHardlink(keep, path string) error {
+	tmpPath := path + ".organise-downloads-link"
+	if err := os.Link(keep, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package dedupe
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupDownloads creates a downloads dir with browser-style duplicates, one of them already organised.
+func setupDownloads(t *testing.T) (rootDir string, rootFiles []string, subDirs []string) {
+	t.Helper()
+	rootDir = t.TempDir()
+	pdfDir := filepath.Join(rootDir, "pdf_files")
+	if err := os.Mkdir(pdfDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"file.pdf":              "report",
+		"file (1).pdf":          "report",
+		"file (2).pdf":          "report",
+		"other.pdf":             "other!", // same size, different content
+		"photo.jpg":             "photo",
+		"photo (1).jpg":         "photo",
+		"empty.txt":             "",
+		"empty (1).txt":         "",
+		"pdf_files/invoice.pdf": "invoice",
+		"invoice.pdf":           "invoice",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(rootDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(name) == "." {
+			rootFiles = append(rootFiles, name)
+		}
+	}
+	return rootDir, rootFiles, []string{pdfDir}
+}
+
+func TestScan(t *testing.T) {
+	rootDir, rootFiles, subDirs := setupDownloads(t)
+
+	groups, err := Scan(context.Background(), rootDir, rootFiles, subDirs, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(groups) != 3 {
+		t.Fatalf("expected 3 groups (empty files are ignored), got %+v", groups)
+	}
+
+	keep := make(map[string]int) // kept file name -> number of duplicates
+	for _, group := range groups {
+		keep[filepath.Base(group.Keep)] = len(group.Duplicates)
+	}
+	expected := map[string]int{"file.pdf": 2, "photo.jpg": 1, "invoice.pdf": 1}
+	for name, count := range expected {
+		if keep[name] != count {
+			t.Errorf("expected %s to be kept with %d duplicate(s), got %v", name, count, keep)
+		}
+	}
+	for _, group := range groups {
+		if filepath.Base(group.Keep) == "invoice.pdf" && filepath.Dir(group.Keep) != subDirs[0] {
+			t.Errorf("expected the organised copy to be kept, got %s", group.Keep)
+		}
+	}
+
+	duplicates := DuplicatesIn(groups, rootDir)
+	for _, name := range []string{"file (1).pdf", "file (2).pdf", "photo (1).jpg", "invoice.pdf"} {
+		if _, ok := duplicates[name]; !ok {
+			t.Errorf("expected %s to be a duplicate in the root dir, got %v", name, duplicates)
+		}
+	}
+	if len(duplicates) != 4 {
+		t.Errorf("expected 4 duplicates in the root dir, got %v", duplicates)
+	}
+}
+
+func TestScan_Cancelled(t *testing.T) {
+	rootDir, rootFiles, subDirs := setupDownloads(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	groups, err := Scan(ctx, rootDir, rootFiles, subDirs, 2)
+	if err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if groups != nil {
+		t.Errorf("expected no groups, got %+v", groups)
+	}
+}
+
+func TestApply(t *testing.T) {
+	t.Run("Report", func(t *testing.T) {
+		rootDir, rootFiles, subDirs := setupDownloads(t)
+		groups, _ := Scan(context.Background(), rootDir, rootFiles, subDirs, 2)
+		if results := Apply(context.Background(), groups, ActionReport, filepath.Join(rootDir, TrashDirName)); results != nil {
+			t.Errorf("expected report to change nothing, got %v", results)
+		}
+	})
+
+	t.Run("Trash", func(t *testing.T) {
+		rootDir, rootFiles, subDirs := setupDownloads(t)
+		groups, _ := Scan(context.Background(), rootDir, rootFiles, subDirs, 2)
+		trashDir := filepath.Join(rootDir, TrashDirName)
+
+		for _, result := range Apply(context.Background(), groups, ActionTrash, trashDir) {
+			if result.Err != nil {
+				t.Errorf("unexpected error for %s: %v", result.Path, result.Err)
+			}
+			if _, err := os.Stat(result.Path); !os.IsNotExist(err) {
+				t.Errorf("expected %s to be moved to the trash", result.Path)
+			}
+		}
+		trashed, err := os.ReadDir(trashDir)
+		if err != nil || len(trashed) != 4 {
+			t.Errorf("expected 4 files in the trash, got %v (%v)", trashed, err)
+		}
+	})
+
+	t.Run("Hardlink", func(t *testing.T) {
+		rootDir, rootFiles, subDirs := setupDownloads(t)
+		groups, _ := Scan(context.Background(), rootDir, rootFiles, subDirs, 2)
+
+		for _, result := range Apply(context.Background(), groups, ActionHardlink, "") {
+			if result.Err != nil {
+				t.Fatalf("unexpected error for %s: %v", result.Path, result.Err)
+			}
+			keepInfo, _ := os.Stat(result.Keep)
+			pathInfo, _ := os.Stat(result.Path)
+			if !os.SameFile(keepInfo, pathInfo) {
+				t.Errorf("expected %s to be a hard link to %s", result.Path, result.Keep)
+			}
+		}
+
+		// Hard links aren't reported as duplicates again.
+		groups, err := Scan(context.Background(), rootDir, rootFiles, subDirs, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(groups) != 0 {
+			t.Errorf("expected no duplicates after hard linking, got %+v", groups)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		rootDir, rootFiles, subDirs := setupDownloads(t)
+		groups, _ := Scan(context.Background(), rootDir, rootFiles, subDirs, 2)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if results := Apply(ctx, groups, ActionTrash, filepath.Join(rootDir, TrashDirName)); len(results) != 0 {
+			t.Errorf("expected nothing to be done once cancelled, got %+v", results)
+		}
+		if _, err := os.Stat(filepath.Join(rootDir, "photo (1).jpg")); err != nil {
+			t.Errorf("expected duplicate to be left alone: %v", err)
+		}
+	})
+
+	t.Run("Changed since scan", func(t *testing.T) {
+		rootDir, rootFiles, subDirs := setupDownloads(t)
+		groups, _ := Scan(context.Background(), rootDir, rootFiles, subDirs, 2)
+		if err := os.WriteFile(filepath.Join(rootDir, "photo (1).jpg"), []byte("edited"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, result := range Apply(context.Background(), groups, ActionTrash, filepath.Join(rootDir, TrashDirName)) {
+			if filepath.Base(result.Path) == "photo (1).jpg" && result.Err == nil {
+				t.Error("expected a file that changed since the scan to be left alone")
+			}
+		}
+	})
+}
+
+func TestParseAction(t *testing.T) {
+	if action, err := ParseAction(""); err != nil || action != ActionOff {
+		t.Errorf("expected empty value to mean %q, got %q (%v)", ActionOff, action, err)
+	}
+	if _, err := ParseAction("shred"); err == nil {
+		t.Error("expected error for unknown action, got nil")
+	}
+}
@@ -0,0 +1,267 @@
+// Content-based file type detection
+package detect
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Mode says whether file contents are inspected, and what happens when the name and the contents disagree.
+type Mode string
+
+const (
+	ModeOff           Mode = "off"            // trust the file name, never read the file
+	ModeExtensionWins Mode = "extension-wins" // read the file only when its extension is missing or isn't plausible
+	ModeContentWins   Mode = "content-wins"   // read every file; the detected type wins when it disagrees with the name
+)
+
+// HeaderSize is the number of bytes read from the start of each file. ISO9660 images are the exception, because their
+// signature lives at a fixed offset past the first 32KiB.
+const HeaderSize = 4096
+
+// iso9660Offsets are the positions of the 'CD001' volume descriptor signature in an ISO9660 image.
+var iso9660Offsets = []int64{0x8001, 0x8801, 0x9001}
+
+// FileType describes a type that can be recognised from its contents.
+type FileType struct {
+	Name      string   // human-readable name, for logging
+	Extension string   // canonical extension, including the leading dot
+	Aliases   []string // other extensions that are consistent with this type
+}
+
+// Matches returns whether fileExtension is consistent with this type.
+func (fileType FileType) Matches(fileExtension string) bool {
+	fileExtension = strings.ToLower(fileExtension)
+	if fileExtension == fileType.Extension {
+		return true
+	}
+	for _, alias := range fileType.Aliases {
+		if fileExtension == alias {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	typePDF      = FileType{"PDF document", ".pdf", nil}
+	typePNG      = FileType{"PNG image", ".png", nil}
+	typeJPEG     = FileType{"JPEG image", ".jpg", []string{".jpeg", ".jpe", ".jfif"}}
+	typeGIF      = FileType{"GIF image", ".gif", nil}
+	typeWebP     = FileType{"WebP image", ".webp", nil}
+	typeWAV      = FileType{"WAVE audio", ".wav", nil}
+	typeAVI      = FileType{"AVI video", ".avi", nil}
+	typeZIP      = FileType{"ZIP archive", ".zip", zipAliases}
+	typeDOCX     = FileType{"Word document", ".docx", zipAliases}
+	typeXLSX     = FileType{"Excel workbook", ".xlsx", zipAliases}
+	typePPTX     = FileType{"PowerPoint presentation", ".pptx", zipAliases}
+	typeEPUB     = FileType{"EPUB book", ".epub", zipAliases}
+	typeELF      = FileType{"ELF binary", ".elf", []string{".so", ".o", ".ko", ".bin", ".run", ".out", ".appimage"}}
+	typePE       = FileType{"Windows executable", ".exe", []string{".dll", ".sys", ".scr", ".efi", ".cpl"}}
+	typeGzip     = FileType{"gzip archive", ".gz", []string{".tgz", ".gzip"}}
+	typeBzip2    = FileType{"bzip2 archive", ".bz2", []string{".tbz", ".tbz2"}}
+	typeXZ       = FileType{"xz archive", ".xz", []string{".txz"}}
+	typeZstd     = FileType{"zstd archive", ".zst", []string{".tzst"}}
+	type7z       = FileType{"7-Zip archive", ".7z", nil}
+	typeRAR      = FileType{"RAR archive", ".rar", nil}
+	typeISO      = FileType{"ISO9660 image", ".iso", []string{".img"}}
+	typeMP4      = FileType{"MPEG-4 media", ".mp4", isoMediaAliases}
+	typeMOV      = FileType{"QuickTime video", ".mov", isoMediaAliases}
+	typeM4A      = FileType{"MPEG-4 audio", ".m4a", isoMediaAliases}
+	typeHEIC     = FileType{"HEIF image", ".heic", isoMediaAliases}
+	typeAVIF     = FileType{"AVIF image", ".avif", isoMediaAliases}
+	typeMatroska = FileType{"Matroska media", ".mkv", []string{".webm", ".mka", ".mk3d"}}
+	typeMP3      = FileType{"MP3 audio", ".mp3", nil}
+	typeOgg      = FileType{"Ogg media", ".ogg", []string{".oga", ".ogv", ".opus"}}
+	typeFLAC     = FileType{"FLAC audio", ".flac", nil}
+	typeSQLite   = FileType{"SQLite database", ".sqlite", []string{".sqlite3", ".db"}}
+
+	// Lots of formats are ZIP files underneath, so a ZIP signature doesn't contradict any of these names.
+	zipAliases = []string{
+		".zip", ".docx", ".xlsx", ".pptx", ".odt", ".ods", ".odp", ".epub", ".jar", ".apk", ".ipa", ".xpi", ".whl",
+		".nupkg", ".vsix", ".kmz", ".cbz",
+	}
+	// ISO base media files share one signature and are told apart by a 'brand' that isn't always reliable.
+	isoMediaAliases = []string{".mp4", ".m4v", ".m4a", ".m4b", ".mov", ".3gp", ".3g2", ".heic", ".heif", ".avif"}
+)
+
+// signature is a run of magic bytes expected at a given offset.
+type signature struct {
+	offset int
+	magic  []byte
+}
+
+// simpleTypes are recognised from one or more signatures that must all be present. Order matters: the first match wins.
+var simpleTypes = []struct {
+	fileType   FileType
+	signatures []signature
+}{
+	{typePDF, []signature{{0, []byte("%PDF-")}}},
+	{typePNG, []signature{{0, []byte("\x89PNG\r\n\x1a\n")}}},
+	{typeJPEG, []signature{{0, []byte("\xff\xd8\xff")}}},
+	{typeGIF, []signature{{0, []byte("GIF87a")}}},
+	{typeGIF, []signature{{0, []byte("GIF89a")}}},
+	{typeWebP, []signature{{0, []byte("RIFF")}, {8, []byte("WEBP")}}},
+	{typeWAV, []signature{{0, []byte("RIFF")}, {8, []byte("WAVE")}}},
+	{typeAVI, []signature{{0, []byte("RIFF")}, {8, []byte("AVI ")}}},
+	{typeELF, []signature{{0, []byte("\x7fELF")}}},
+	{typeGzip, []signature{{0, []byte("\x1f\x8b")}}},
+	{typeBzip2, []signature{{0, []byte("BZh")}}},
+	{typeXZ, []signature{{0, []byte("\xfd7zXZ\x00")}}},
+	{typeZstd, []signature{{0, []byte("\x28\xb5\x2f\xfd")}}},
+	{type7z, []signature{{0, []byte("7z\xbc\xaf\x27\x1c")}}},
+	{typeRAR, []signature{{0, []byte("Rar!\x1a\x07")}}},
+	{typeMatroska, []signature{{0, []byte("\x1a\x45\xdf\xa3")}}},
+	{typeMP3, []signature{{0, []byte("ID3")}}},
+	{typeOgg, []signature{{0, []byte("OggS")}}},
+	{typeFLAC, []signature{{0, []byte("fLaC")}}},
+	{typeSQLite, []signature{{0, []byte("SQLite format 3\x00")}}},
+	{typePE, []signature{{0, []byte("MZ")}}},
+}
+
+// ParseMode converts a value read from TOML into a Mode. An empty value means ModeOff.
+func ParseMode(value string) (Mode, error) {
+	switch mode := Mode(value); mode {
+	case "":
+		return ModeOff, nil
+	case ModeOff, ModeExtensionWins, ModeContentWins:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown content detection mode %q (expected %q, %q or %q)",
+		value, ModeOff, ModeExtensionWins, ModeContentWins)
+}
+
+// Sniff returns the type recognised from the contents of r, if any.
+func Sniff(r io.ReaderAt) (fileType FileType, ok bool) {
+	header := make([]byte, HeaderSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return FileType{}, false
+	}
+	header = header[:n]
+
+	for _, candidate := range simpleTypes {
+		if hasSignatures(header, candidate.signatures) {
+			return candidate.fileType, true
+		}
+	}
+
+	if bytes.HasPrefix(header, []byte("PK\x03\x04")) {
+		return sniffZip(header), true
+	}
+
+	if len(header) >= 12 && bytes.Equal(header[4:8], []byte("ftyp")) {
+		return sniffISOMedia(header[8:12]), true
+	}
+
+	magic := make([]byte, 5)
+	for _, offset := range iso9660Offsets {
+		if n, _ := r.ReadAt(magic, offset); n == len(magic) && bytes.Equal(magic, []byte("CD001")) {
+			return typeISO, true
+		}
+	}
+
+	return FileType{}, false
+}
+
+// SniffFile opens the file at path and returns the type recognised from its contents, if any.
+func SniffFile(path string) (fileType FileType, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileType{}, false, err
+	}
+	defer f.Close()
+
+	fileType, ok = Sniff(f)
+	return fileType, ok, nil
+}
+
+// Extension returns the extension that should be used to classify the file at path, according to mode.
+//
+// The extension from the file name is returned unchanged unless mode allows inspecting the file and the contents
+// are recognised. Errors reading the file are returned alongside the name's extension, so callers can fall back to it.
+func Extension(mode Mode, path string) (fileExtension string, err error) {
+	fileExtension = filepath.Ext(path)
+	if mode == ModeOff || mode == "" {
+		return fileExtension, nil
+	}
+
+	plausible := IsPlausibleExtension(fileExtension)
+	if mode == ModeExtensionWins && plausible {
+		return fileExtension, nil
+	}
+
+	fileType, ok, err := SniffFile(path)
+	if err != nil || !ok {
+		return fileExtension, err
+	}
+	if plausible && fileType.Matches(fileExtension) {
+		return fileExtension, nil
+	}
+	return fileType.Extension, nil
+}
+
+// IsPlausibleExtension returns whether fileExtension looks like a real extension rather than, say, the query string
+// left over from a URL ('.php?id=3') or the tail of a name with dots in it ('.2 final').
+func IsPlausibleExtension(fileExtension string) bool {
+	if len(fileExtension) < 2 || len(fileExtension) > 16 || fileExtension[0] != '.' {
+		return false
+	}
+	for _, char := range fileExtension[1:] {
+		isAlphaNumeric := ('a' <= char && char <= 'z') || ('A' <= char && char <= 'Z') || ('0' <= char && char <= '9')
+		if !isAlphaNumeric && char != '_' && char != '-' && char != '+' {
+			return false
+		}
+	}
+	return true
+}
+
+// hasSignatures returns whether every signature is present in header.
+func hasSignatures(header []byte, signatures []signature) bool {
+	for _, this := range signatures {
+		end := this.offset + len(this.magic)
+		if end > len(header) || !bytes.Equal(header[this.offset:end], this.magic) {
+			return false
+		}
+	}
+	return true
+}
+
+// sniffZip tells plain ZIP archives apart from the document formats built on top of them.
+func sniffZip(header []byte) FileType {
+	// EPUB and OpenDocument store an uncompressed 'mimetype' entry first, right after the 30-byte local header.
+	if bytes.HasPrefix(header[min(30, len(header)):], []byte("mimetypeapplication/epub+zip")) {
+		return typeEPUB
+	}
+	if bytes.Contains(header, []byte("[Content_Types].xml")) || bytes.Contains(header, []byte("_rels/.rels")) {
+		switch {
+		case bytes.Contains(header, []byte("word/")):
+			return typeDOCX
+		case bytes.Contains(header, []byte("xl/")):
+			return typeXLSX
+		case bytes.Contains(header, []byte("ppt/")):
+			return typePPTX
+		}
+	}
+	return typeZIP
+}
+
+// sniffISOMedia picks a type from the major brand of an ISO base media ('ftyp') file.
+func sniffISOMedia(brand []byte) FileType {
+	switch string(brand) {
+	case "qt  ":
+		return typeMOV
+	case "M4A ", "M4B ":
+		return typeM4A
+	case "heic", "heix", "mif1", "msf1":
+		return typeHEIC
+	case "avif", "avis":
+		return typeAVIF
+	}
+	return typeMP4
+}
@@ -0,0 +1,110 @@
+package detect
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// isoImage returns the start of a fake ISO9660 image with its volume descriptor signature in place.
+func isoImage() []byte {
+	image := make([]byte, 0x8001+16)
+	copy(image[0x8001:], "CD001")
+	return image
+}
+
+func TestSniff(t *testing.T) {
+	testCases := []struct {
+		name      string
+		content   []byte
+		extension string
+		ok        bool
+	}{
+		{"PDF", []byte("%PDF-1.7\n%..."), ".pdf", true},
+		{"PNG", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), ".png", true},
+		{"JPEG", []byte("\xff\xd8\xff\xe0\x00\x10JFIF"), ".jpg", true},
+		{"WebP", []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), ".webp", true},
+		{"ZIP", []byte("PK\x03\x04\x14\x00\x00\x00hello.txt"), ".zip", true},
+		{"DOCX", []byte("PK\x03\x04\x14\x00[Content_Types].xml....PK\x03\x04word/document.xml"), ".docx", true},
+		{"XLSX", []byte("PK\x03\x04\x14\x00[Content_Types].xml....PK\x03\x04xl/workbook.xml"), ".xlsx", true},
+		{"ELF", []byte("\x7fELF\x02\x01\x01"), ".elf", true},
+		{"gzip", []byte("\x1f\x8b\x08\x00"), ".gz", true},
+		{"MP4", []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00"), ".mp4", true},
+		{"QuickTime", []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00"), ".mov", true},
+		{"ISO9660", isoImage(), ".iso", true},
+		{"Plain text", []byte("just some notes\n"), "", false},
+		{"Empty", []byte{}, "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fileType, ok := Sniff(bytes.NewReader(tc.content))
+			if ok != tc.ok {
+				t.Fatalf("expected ok=%v, got %v", tc.ok, ok)
+			}
+			if fileType.Extension != tc.extension {
+				t.Errorf("expected extension %q, got %q", tc.extension, fileType.Extension)
+			}
+		})
+	}
+}
+
+func TestExtension(t *testing.T) {
+	pdf := []byte("%PDF-1.4\n")
+	testCases := []struct {
+		name     string
+		mode     Mode
+		fileName string
+		content  []byte
+		expected string
+	}{
+		{"Off ignores content", ModeOff, "download", pdf, ""},
+		{"Missing extension", ModeExtensionWins, "download", pdf, ".pdf"},
+		{"URL left-overs", ModeExtensionWins, "file.php?id=3", pdf, ".pdf"},
+		{"Extension wins on mismatch", ModeExtensionWins, "report.txt", pdf, ".txt"},
+		{"Content wins on mismatch", ModeContentWins, "report.txt", pdf, ".pdf"},
+		{"Compatible alias is kept", ModeContentWins, "photo.JPEG", []byte("\xff\xd8\xff\xe1"), ".JPEG"},
+		{"Unknown content keeps extension", ModeContentWins, "notes.md", []byte("# notes"), ".md"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.fileName)
+			if err := os.WriteFile(path, tc.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := Extension(tc.mode, path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+
+	t.Run("Unreadable file falls back to the name", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "missing.bin")
+		got, err := Extension(ModeContentWins, path)
+		if err == nil {
+			t.Error("expected error for missing file, got nil")
+		}
+		if got != ".bin" {
+			t.Errorf("expected '.bin', got %q", got)
+		}
+	})
+}
+
+func TestParseMode(t *testing.T) {
+	if mode, err := ParseMode(""); err != nil || mode != ModeOff {
+		t.Errorf("expected empty value to mean %q, got %q (%v)", ModeOff, mode, err)
+	}
+	if mode, err := ParseMode("content-wins"); err != nil || mode != ModeContentWins {
+		t.Errorf("expected %q, got %q (%v)", ModeContentWins, mode, err)
+	}
+	if _, err := ParseMode("sometimes"); err == nil {
+		t.Error("expected error for unknown mode, got nil")
+	}
+}
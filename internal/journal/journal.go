@@ -0,0 +1,253 @@
+// Append-only record of completed moves, so a run can be undone
+package journal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileName is the name of the journal file inside the state dir.
+const FileName = "journal.jsonl"
+
+const (
+	OpMove = "move" // a file was moved from Source to Destination
+	OpUndo = "undo" // a move was reverted, i.e. the file went from Destination back to Source
+)
+
+// Entry is one line of the journal.
+type Entry struct {
+	RunID       string    `json:"run"`
+	Op          string    `json:"op"`
+	Source      string    `json:"src"`
+	Destination string    `json:"dst"`
+	Time        time.Time `json:"time"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mtime"`
+	CreatedDir  string    `json:"createdDir,omitempty"` // dir created to hold Destination, removed on undo if only empty dirs are left in it
+}
+
+// Journal appends entries for a single run to the journal file. It's safe for concurrent use.
+type Journal struct {
+	mu    sync.Mutex
+	file  *os.File
+	runID string
+}
+
+// NewRunID returns an ID that sorts by start time and is unique enough to tell runs apart.
+func NewRunID() string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// Open opens the journal at path for appending, creating it if needed, and starts a new run.
+func Open(path string) (*Journal, error) {
+	return OpenRun(path, NewRunID())
+}
+
+// OpenRun opens the journal at path for appending entries that belong to runID.
+func OpenRun(path, runID string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{file: file, runID: runID}, nil
+}
+
+// RunID returns the ID written with every entry.
+func (journal *Journal) RunID() string {
+	return journal.runID
+}
+
+// RecordMove appends a move entry. info describes the file at its destination and is used by Undo to tell whether the
+// file changed after it was moved. createdDir is the dir that had to be created for this move, if any.
+func (journal *Journal) RecordMove(source, destination string, info fs.FileInfo, createdDir string) error {
+	return journal.write(Entry{
+		Op:          OpMove,
+		Source:      source,
+		Destination: destination,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		CreatedDir:  createdDir,
+	})
+}
+
+// write stamps entry with the run ID and time, and appends it as a single line.
+func (journal *Journal) write(entry Entry) error {
+	entry.RunID = journal.runID
+	entry.Time = time.Now()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	_, err = journal.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the journal file.
+func (journal *Journal) Close() error {
+	return journal.file.Close()
+}
+
+// ReadEntries returns every entry in the journal at path, oldest first. A missing journal has no entries.
+func ReadEntries(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// LastRun returns the ID of the most recent run that has a move that hasn't been undone, or "" if there isn't one. A run
+// whose undo skipped some files is still the last run, so undoing it again retries them.
+func LastRun(entries []Entry) string {
+	type runMove struct{ runID, destination string }
+	undone := make(map[runMove]bool)
+	for _, entry := range entries {
+		if entry.Op == OpUndo {
+			undone[runMove{entry.RunID, entry.Destination}] = true
+		}
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Op == OpMove && !undone[runMove{entries[i].RunID, entries[i].Destination}] {
+			return entries[i].RunID
+		}
+	}
+	return ""
+}
+
+// UndoResult says what happened to one file when its run was undone.
+type UndoResult struct {
+	Entry    Entry
+	Restored bool
+	Reason   string // why the file was skipped, if it wasn't restored
+}
+
+// MoveFunc moves the file at source to destination. It must not replace an existing destination, but fail with an
+// error matching fs.ErrExist instead.
+type MoveFunc func(source, destination string) error
+
+// Undo moves every file of runID back where it came from with moveBack, newest move first, and records each restored
+// file in journal. Files that were modified or moved since, or whose original path is taken, are skipped. Dirs created
+// by the run are removed once they're empty.
+func Undo(journal *Journal, entries []Entry, runID string, moveBack MoveFunc) ([]UndoResult, error) {
+	alreadyUndone := make(map[string]bool)
+	var moves []Entry
+	for _, entry := range entries {
+		if entry.RunID != runID {
+			continue
+		}
+		switch entry.Op {
+		case OpMove:
+			moves = append(moves, entry)
+		case OpUndo:
+			alreadyUndone[entry.Destination] = true
+		}
+	}
+	if len(moves) == 0 {
+		return nil, fmt.Errorf("no moves recorded for run %q", runID)
+	}
+
+	var results []UndoResult
+	var createdDirs []string
+	for i := len(moves) - 1; i >= 0; i-- {
+		move := moves[i]
+		if move.CreatedDir != "" {
+			createdDirs = append(createdDirs, move.CreatedDir)
+		}
+		if alreadyUndone[move.Destination] {
+			continue
+		}
+
+		result := UndoResult{Entry: move}
+		result.Reason = undoMove(move, moveBack)
+		if result.Reason == "" {
+			result.Restored = true
+			undoEntry := move
+			undoEntry.Op = OpUndo
+			undoEntry.CreatedDir = ""
+			if err := journal.write(undoEntry); err != nil {
+				return results, err
+			}
+		}
+		results = append(results, result)
+	}
+
+	for _, dir := range createdDirs {
+		removeEmptyDirs(dir)
+	}
+	return results, nil
+}
+
+// removeEmptyDirs removes dir if nothing is left in it but empty dirs, which are removed too, and returns whether it
+// did. A move can create a subdir along with the dirs under it that the file was nested in.
+func removeEmptyDirs(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	empty := true
+	for _, entry := range entries {
+		if !entry.IsDir() || !removeEmptyDirs(filepath.Join(dir, entry.Name())) {
+			empty = false
+		}
+	}
+	return empty && os.Remove(dir) == nil
+}
+
+// undoMove moves a single file back to its source with moveBack. It returns why the file was skipped, or "" if it was
+// restored.
+func undoMove(move Entry, moveBack MoveFunc) (reason string) {
+	info, err := os.Lstat(move.Destination)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "no longer at its destination"
+	} else if err != nil {
+		return err.Error()
+	}
+	if info.Size() != move.Size || !info.ModTime().Equal(move.ModTime) {
+		return "modified since it was moved"
+	}
+
+	if _, err := os.Lstat(move.Source); err == nil {
+		return "original path is taken"
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err.Error()
+	}
+	if err := os.MkdirAll(filepath.Dir(move.Source), 0755); err != nil {
+		return err.Error()
+	}
+	if err := moveBack(move.Destination, move.Source); errors.Is(err, fs.ErrExist) {
+		return "original path is taken"
+	} else if err != nil {
+		return err.Error()
+	}
+	return ""
+}
@@ -0,0 +1,202 @@
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordTestMove moves name from sourceDir into subDir, creating it if needed, and records the move in journal.
+func recordTestMove(t *testing.T, journal *Journal, sourceDir, subDir, name string) {
+	t.Helper()
+	srcFilePath := filepath.Join(sourceDir, name)
+	if err := os.WriteFile(srcFilePath, []byte(name), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dstSubDir := filepath.Join(sourceDir, subDir)
+	createdDir := ""
+	if _, err := os.Stat(dstSubDir); os.IsNotExist(err) {
+		if err := os.Mkdir(dstSubDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		createdDir = dstSubDir
+	}
+
+	dstFilePath := filepath.Join(dstSubDir, name)
+	if err := os.Rename(srcFilePath, dstFilePath); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dstFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.RecordMove(srcFilePath, dstFilePath, info, createdDir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReadEntriesAndLastRun(t *testing.T) {
+	journalPath := filepath.Join(t.TempDir(), FileName)
+
+	entries, err := ReadEntries(journalPath)
+	if err != nil || entries != nil {
+		t.Fatalf("expected a missing journal to have no entries, got %v (%v)", entries, err)
+	}
+	if runID := LastRun(entries); runID != "" {
+		t.Errorf("expected no last run, got %q", runID)
+	}
+
+	sourceDir := t.TempDir()
+	for _, runID := range []string{"run-1", "run-2"} {
+		journal, err := OpenRun(journalPath, runID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recordTestMove(t, journal, sourceDir, "txt_files", runID+".txt")
+		journal.Close()
+	}
+
+	entries, err = ReadEntries(journalPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", entries)
+	}
+	if runID := LastRun(entries); runID != "run-2" {
+		t.Errorf("expected last run to be 'run-2', got %q", runID)
+	}
+
+	undoEntry := entries[1]
+	undoEntry.Op = OpUndo
+	entries = append(entries, undoEntry)
+	if runID := LastRun(entries); runID != "run-1" {
+		t.Errorf("expected undone runs to be skipped, got %q", runID)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	journalPath := filepath.Join(t.TempDir(), FileName)
+	sourceDir := t.TempDir()
+
+	journal, err := Open(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	recordTestMove(t, journal, sourceDir, "pdf_files", "restored.pdf")
+	recordTestMove(t, journal, sourceDir, "txt_files", "restored.txt")
+	recordTestMove(t, journal, sourceDir, "txt_files", "modified.txt")
+	recordTestMove(t, journal, sourceDir, "txt_files", "taken.txt")
+
+	// Change the world after the run.
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(sourceDir, "txt_files", "modified.txt"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sourceDir, "taken.txt"), []byte("new download"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ReadEntries(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := Undo(journal, entries, journal.RunID(), os.Rename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	restored := make(map[string]bool)
+	for _, result := range results {
+		restored[filepath.Base(result.Entry.Source)] = result.Restored
+	}
+	expected := map[string]bool{"restored.pdf": true, "restored.txt": true, "modified.txt": false, "taken.txt": false}
+	for name, wantRestored := range expected {
+		if restored[name] != wantRestored {
+			t.Errorf("expected %s restored=%v, got %v", name, wantRestored, restored[name])
+		}
+	}
+	if results[0].Entry.Source != filepath.Join(sourceDir, "taken.txt") {
+		t.Errorf("expected newest move to be undone first, got %v", results[0].Entry.Source)
+	}
+
+	if _, err := os.Stat(filepath.Join(sourceDir, "pdf_files")); !os.IsNotExist(err) {
+		t.Errorf("expected empty created dir to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sourceDir, "txt_files")); err != nil {
+		t.Errorf("expected non-empty created dir to be kept, got %v", err)
+	}
+
+	// Undoing the same run again only retries the files that were skipped, and -last still finds it.
+	entries, err = ReadEntries(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runID := LastRun(entries); runID != journal.RunID() {
+		t.Errorf("expected a partly undone run to still be the last run, got %q", runID)
+	}
+	results, err = Undo(journal, entries, journal.RunID(), os.Rename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 2 {
+		t.Errorf("expected only the 2 skipped files to be retried, got %v", results)
+	}
+
+	t.Run("Unknown run", func(t *testing.T) {
+		if _, err := Undo(journal, entries, "no-such-run", os.Rename); err == nil {
+			t.Error("expected error for unknown run, got nil")
+		}
+	})
+}
+
+func TestRemoveEmptyDirs(t *testing.T) {
+	tests := []struct {
+		name          string
+		files         []string // created under the dir, along with the dirs they're in
+		dirs          []string // empty dirs created under the dir
+		expectRemoved bool
+		expectLeft    []string
+	}{
+		{"Empty", nil, nil, true, nil},
+		{"Only empty dirs", nil, []string{"unpacked/deep", "other"}, true, nil},
+		{"A file deep down", []string{"unpacked/deep/a.txt"}, []string{"other"}, false, []string{"unpacked/deep/a.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "txt_files")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range tt.dirs {
+				if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if removed := removeEmptyDirs(dir); removed != tt.expectRemoved {
+				t.Errorf("expected removed=%v, got %v", tt.expectRemoved, removed)
+			}
+			for _, name := range tt.expectLeft {
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					t.Errorf("expected %s to be kept, got %v", name, err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, "other")); !os.IsNotExist(err) {
+				t.Errorf("expected empty dirs to be removed, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+// Single-instance lock, so runs don't overlap
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileName is the name of the lock file inside the state dir.
+const FileName = "organise-downloads.lock"
+
+// SessionFileName is the name of the lock file, inside the state dir, that a long-running session holds for as long as
+// it runs, so only one session at a time uses the state it keeps there.
+const SessionFileName = "organise-downloads-session.lock"
+
+// pollInterval is how often Acquire tries again while it waits.
+const pollInterval = 100 * time.Millisecond
+
+// ErrLocked means another process holds the lock.
+var ErrLocked = errors.New("another instance of organise-downloads is running")
+
+// Lock is an exclusive advisory lock on a file, which records the PID of the process that holds it.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire takes the lock at path, creating the file if needed. If another process holds it, Acquire keeps trying for
+// up to wait, then returns an error that matches ErrLocked and names the holder's PID.
+func Acquire(path string, wait time.Duration) (*Lock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err = tryLock(file)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrLocked) || !time.Now().Before(deadline) {
+			file.Close()
+			if errors.Is(err, ErrLocked) {
+				if pid, pidErr := HolderPID(path); pidErr == nil {
+					return nil, fmt.Errorf("%w (PID %d holds %s)", ErrLocked, pid, path)
+				}
+			}
+			return nil, err
+		}
+		time.Sleep(min(pollInterval, time.Until(deadline)))
+	}
+
+	// The lock is only advisory, so the file itself stays readable for HolderPID.
+	if err := file.Truncate(0); err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Lock{file: file}, nil
+}
+
+// Release clears the recorded PID and gives up the lock. The file is kept: removing it would let two processes lock
+// different files with the same name.
+func (lock *Lock) Release() error {
+	truncateErr := lock.file.Truncate(0)
+	return errors.Join(truncateErr, lock.file.Close()) // closing the file releases the lock
+}
+
+// HolderPID returns the PID recorded in the lock file at path.
+func HolderPID(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
@@ -0,0 +1,64 @@
+package lock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	held, err := Acquire(path, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pid, err := HolderPID(path); err != nil || pid != os.Getpid() {
+		t.Errorf("expected the lock file to record PID %d, got %d (%v)", os.Getpid(), pid, err)
+	}
+
+	t.Run("Held", func(t *testing.T) {
+		start := time.Now()
+		_, err := Acquire(path, 0)
+		if !errors.Is(err, ErrLocked) {
+			t.Fatalf("expected ErrLocked, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "PID "+strconv.Itoa(os.Getpid())) {
+			t.Errorf("expected the error to name the holder, got %q", err)
+		}
+		if time.Since(start) > time.Second {
+			t.Error("expected to give up straight away without a wait")
+		}
+	})
+
+	t.Run("Wait times out", func(t *testing.T) {
+		start := time.Now()
+		if _, err := Acquire(path, 150*time.Millisecond); !errors.Is(err, ErrLocked) {
+			t.Fatalf("expected ErrLocked, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Errorf("expected to wait, gave up after %v", elapsed)
+		}
+	})
+
+	t.Run("Wait succeeds", func(t *testing.T) {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			held.Release()
+		}()
+		lock, err := Acquire(path, 5*time.Second)
+		if err != nil {
+			t.Fatalf("expected to get the lock once released, got %v", err)
+		}
+		if err := lock.Release(); err != nil {
+			t.Errorf("unexpected error releasing: %v", err)
+		}
+	})
+
+	if _, err := HolderPID(path); err == nil {
+		t.Error("expected no PID once the lock is released")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package lock
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// tryLock takes an exclusive lock on file without blocking. The locked byte is far beyond the end of the file, as
+// Windows locks are mandatory and would otherwise stop HolderPID from reading it.
+func tryLock(file *os.File) error {
+	overlapped := windows.Overlapped{OffsetHigh: 1}
+	err := windows.LockFileEx(windows.Handle(file.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &overlapped)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return ErrLocked
+	}
+	return err
+}
@@ -2,47 +2,108 @@
 package logging
 
 import (
-	"errors"
-	"io/fs"
-	"log"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
 	"github.com/rs/zerolog"
 )
 
-var (
-	defaultLogParentDir  string = "Downloads"
-	LogFileName          string = "organise-downloads.log"
-	LogDir               string = "log_files"
-	ConfiguredZerologger zerolog.Logger
-)
+// LogFileName is the name of the log file in the state dir, unless another path is configured.
+var LogFileName string = "organise-downloads.log"
 
 type Zerologger struct {
 	zerolog.Logger
 }
 
-// InitZeroLog configures a zerolog Logger and returns an instance of the Zerologr struct that contains it.
-func InitZeroLog() Zerologger {
-	userHomeDir, _ := os.UserHomeDir()
-	logDirPath := filepath.Join(userHomeDir, defaultLogParentDir, LogDir)
+// Sink is where log entries are written.
+type Sink string
+
+const (
+	SinkFile   Sink = "file"   // the log file
+	SinkStderr Sink = "stderr" // standard error, where systemd and launchd collect it
+	SinkBoth   Sink = "both"   // the log file and standard error
+)
+
+// Format is how log entries are written.
+type Format string
+
+const (
+	FormatJSON   Format = "json"   // one JSON object per line
+	FormatPretty Format = "pretty" // zerolog's human-readable console output
+)
+
+// Options configures the logger returned by New.
+type Options struct {
+	Sink     Sink
+	Path     string // the log file; not needed if Sink is SinkStderr
+	Format   Format
+	Caller   bool     // whether entries record the file and line that logged them
+	Rotation Rotation // how the log file is rotated
+}
+
+// ParseSink converts a value read from TOML or the command line into a Sink. An empty value means SinkFile.
+func ParseSink(value string) (Sink, error) {
+	switch sink := Sink(value); sink {
+	case "":
+		return SinkFile, nil
+	case SinkFile, SinkStderr, SinkBoth:
+		return sink, nil
+	}
+	return "", fmt.Errorf("unknown log sink %q (expected %q, %q or %q)", value, SinkFile, SinkStderr, SinkBoth)
+}
+
+// ParseFormat converts a value read from TOML or the command line into a Format. An empty value means FormatJSON.
+func ParseFormat(value string) (Format, error) {
+	switch format := Format(value); format {
+	case "":
+		return FormatJSON, nil
+	case FormatJSON, FormatPretty:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown log format %q (expected %q or %q)", value, FormatJSON, FormatPretty)
+}
 
-	// check if logDirPath exists; create it if not.
-	_, err := os.Stat(logDirPath)
-	if errors.Is(err, fs.ErrNotExist) {
-		err = os.Mkdir(logDirPath, 0777)
+// New configures a zerolog Logger according to options and returns an instance of the Zerologger struct that contains
+// it. The log file's dir is created if needed.
+func New(options Options) (Zerologger, error) {
+	var writers []io.Writer
+	if options.Sink != SinkStderr {
+		if err := os.MkdirAll(filepath.Dir(options.Path), 0700); err != nil {
+			return Zerologger{}, fmt.Errorf("unable to create logging dir: %w", err)
+		}
+		file, err := openRotatingFile(options.Path, options.Rotation)
 		if err != nil {
-			log.Fatalf("unable to create logging dir %v", logDirPath)
+			return Zerologger{}, fmt.Errorf("cannot write to log file %v: %w", options.Path, err)
 		}
+		writers = append(writers, format(file, options.Format, true))
+	}
+	if options.Sink == SinkStderr || options.Sink == SinkBoth {
+		writers = append(writers, format(os.Stderr, options.Format, !isTerminal(os.Stderr)))
 	}
 
-	logFilePath := filepath.Join(logDirPath, LogFileName)
+	context := zerolog.New(zerolog.MultiLevelWriter(writers...)).With().Timestamp()
+	if options.Caller {
+		context = context.Caller()
+	}
+	return Zerologger{context.Logger()}, nil
+}
 
-	file, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		log.Panicf("Cannot write to log file %v - %v", logFilePath, err)
+// prettyTimeFormat is how entries are timestamped in FormatPretty.
+const prettyTimeFormat = "2006-01-02 15:04:05"
+
+// format wraps w so entries are written in format. Colours are only used in pretty output, and only if noColor is
+// false.
+func format(w io.Writer, format Format, noColor bool) io.Writer {
+	if format == FormatPretty {
+		return zerolog.ConsoleWriter{Out: w, NoColor: noColor, TimeFormat: prettyTimeFormat}
 	}
+	return w
+}
 
-	ConfiguredZerologger = zerolog.New(file).With().Timestamp().Caller().Logger()
-	return Zerologger{ConfiguredZerologger}
+// isTerminal returns whether file is a terminal, rather than a pipe to a log collector like journald.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
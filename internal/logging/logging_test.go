@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		caller bool
+		check  func(t *testing.T, line string)
+	}{
+		{
+			name: "JSON", format: FormatJSON, caller: true,
+			check: func(t *testing.T, line string) {
+				var entry map[string]any
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("expected a JSON line, got %q", line)
+				}
+				if entry["message"] != "hello" || entry["caller"] == nil {
+					t.Errorf("expected message and caller, got %v", entry)
+				}
+			},
+		},
+		{
+			name: "Pretty without caller", format: FormatPretty,
+			check: func(t *testing.T, line string) {
+				if strings.HasPrefix(line, "{") || !strings.Contains(line, "INF hello") {
+					t.Errorf("expected console output, got %q", line)
+				}
+				if strings.Contains(line, "logging_test.go") {
+					t.Errorf("expected no caller, got %q", line)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The dir doesn't exist yet, and is created.
+			path := filepath.Join(t.TempDir(), "state", LogFileName)
+			logger, err := New(Options{Sink: SinkFile, Path: path, Format: tt.format, Caller: tt.caller})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			logger.Info().Msg("hello")
+
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, strings.TrimSpace(string(content)))
+			if info, _ := os.Stat(filepath.Dir(path)); info.Mode().Perm() != 0700 {
+				t.Errorf("expected the logging dir to be private, got %v", info.Mode().Perm())
+			}
+		})
+	}
+
+	t.Run("Stderr only", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), LogFileName)
+		if _, err := New(Options{Sink: SinkStderr, Path: path}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected no log file, got %v", err)
+		}
+	})
+}
+
+func TestParseSinkAndFormat(t *testing.T) {
+	if sink, err := ParseSink(""); err != nil || sink != SinkFile {
+		t.Errorf("expected empty sink to mean %q, got %q (%v)", SinkFile, sink, err)
+	}
+	if _, err := ParseSink("syslog"); err == nil {
+		t.Error("expected error for unknown sink, got nil")
+	}
+	if format, err := ParseFormat(""); err != nil || format != FormatJSON {
+		t.Errorf("expected empty format to mean %q, got %q (%v)", FormatJSON, format, err)
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("expected error for unknown format, got nil")
+	}
+}
@@ -0,0 +1,246 @@
+package logging
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Rotation controls when the log file is rotated and how many rotated files are kept. The zero value never rotates.
+type Rotation struct {
+	MaxSize  int64         // rotate before the file grows past this many bytes; 0 means no limit
+	MaxAge   time.Duration // rotate once the file has been written to for this long; 0 means no limit
+	Keep     int           // rotated files to keep; older ones are deleted. 0 keeps them all
+	Compress bool          // gzip rotated files
+}
+
+// reopenCheckInterval is how often a rotatingFile checks whether another process rotated the file under it.
+const reopenCheckInterval = time.Second
+
+// now is time.Now; tests replace it to rotate by age.
+var now = time.Now
+
+// rotatingFile is an io.Writer that appends to a log file and rotates it according to a Rotation. Rotated files are
+// renamed with a timestamp, e.g. 'organise-downloads-20260107T100126.000.log', so processes that share the log never
+// need to rename each other's backups. It's safe for concurrent use.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	rotation Rotation
+	file     *os.File
+	size     int64
+	started  time.Time // when the current file was started, as far as we know
+	checked  time.Time // when we last checked that path is still the file we have open
+}
+
+// openRotatingFile opens path for appending, creating it if needed.
+func openRotatingFile(path string, rotation Rotation) (*rotatingFile, error) {
+	w := &rotatingFile{path: path, rotation: rotation}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write appends p to the log file, rotating it first if p would take it past a limit. If rotating fails, p is still
+// written to the current file, and the error is reported on stderr, as there's no other log to report it in.
+func (w *rotatingFile) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if now().Sub(w.checked) >= reopenCheckInterval {
+		w.reopenIfMoved()
+	}
+	if w.shouldRotate(len(p)) {
+		if err := w.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to rotate log file %s: %v\n", w.path, err)
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close closes the log file.
+func (w *rotatingFile) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// open opens w.path for appending and resets what's known about it. A file that already has entries was started when
+// the first of them was written, so runs that each write a little, like a timer or cron job, still rotate it by age.
+func (w *rotatingFile) open() error {
+	file, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file, w.size, w.started, w.checked = file, info.Size(), now(), now()
+	if info.Size() > 0 {
+		w.started = startedAt(file, info)
+	}
+	return nil
+}
+
+// firstLineLength is how much of a log file startedAt reads to find its first entry.
+const firstLineLength = 4096
+
+// startedAt returns when the log file was started: the time of its first entry, in either format, or if that can't be
+// read, when it was last modified, which is the latest it can have been started.
+func startedAt(file *os.File, info fs.FileInfo) time.Time {
+	buf := make([]byte, firstLineLength)
+	n, _ := file.ReadAt(buf, 0)
+	firstLine, _, _ := strings.Cut(string(buf[:n]), "\n")
+
+	var entry struct {
+		Time string `json:"time"`
+	}
+	if json.Unmarshal([]byte(firstLine), &entry) == nil {
+		if started, err := time.Parse(zerolog.TimeFieldFormat, entry.Time); err == nil {
+			return started
+		}
+	}
+	if len(firstLine) >= len(prettyTimeFormat) {
+		if started, err := time.ParseInLocation(prettyTimeFormat, firstLine[:len(prettyTimeFormat)], time.Local); err == nil {
+			return started
+		}
+	}
+	return info.ModTime()
+}
+
+// reopenIfMoved reopens w.path if another process, such as a second instance, rotated it while we had it open.
+// Otherwise a daemon that runs for weeks would keep writing to a rotated file.
+func (w *rotatingFile) reopenIfMoved() {
+	w.checked = now()
+	pathInfo, pathErr := os.Stat(w.path)
+	fileInfo, fileErr := w.file.Stat()
+	if pathErr == nil && fileErr == nil && os.SameFile(pathInfo, fileInfo) {
+		return
+	}
+	oldFile := w.file
+	if err := w.open(); err != nil {
+		w.file = oldFile // keep writing somewhere
+		return
+	}
+	oldFile.Close()
+}
+
+// shouldRotate returns whether the file must be rotated before writing another n bytes. Empty files are never rotated.
+func (w *rotatingFile) shouldRotate(n int) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.rotation.MaxSize > 0 && w.size+int64(n) > w.rotation.MaxSize {
+		return true
+	}
+	return w.rotation.MaxAge > 0 && now().Sub(w.started) >= w.rotation.MaxAge
+}
+
+// rotate renames the current file to a timestamped backup, starts a new one, and compresses and prunes backups.
+func (w *rotatingFile) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	extension := filepath.Ext(w.path)
+	backupPath := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(w.path, extension), now().Format("20060102T150405.000"),
+		extension)
+	renameErr := os.Rename(w.path, backupPath)
+	if err := w.open(); err != nil {
+		return errors.Join(renameErr, err)
+	}
+	if errors.Is(renameErr, fs.ErrNotExist) {
+		return nil // another process rotated it first
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	var err error
+	if w.rotation.Compress {
+		err = compressFile(backupPath)
+	}
+	return errors.Join(err, w.prune())
+}
+
+// backups returns the paths of the rotated files, oldest first.
+func (w *rotatingFile) backups() ([]string, error) {
+	extension := filepath.Ext(w.path)
+	matches, err := filepath.Glob(strings.TrimSuffix(w.path, extension) + "-*" + extension + "*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches) // the timestamps sort by time
+	return matches, nil
+}
+
+// prune deletes the oldest backups beyond rotation.Keep.
+func (w *rotatingFile) prune() error {
+	if w.rotation.Keep <= 0 {
+		return nil
+	}
+	backups, err := w.backups()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for len(backups) > w.rotation.Keep {
+		if err := os.Remove(backups[0]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+		backups = backups[1:]
+	}
+	return errors.Join(errs...)
+}
+
+// compressFile replaces path with a gzipped copy named path + '.gz'.
+func compressFile(path string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	gzipWriter := gzip.NewWriter(dst)
+	if _, err = io.Copy(gzipWriter, src); err != nil {
+		return err
+	}
+	if err = gzipWriter.Close(); err != nil {
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
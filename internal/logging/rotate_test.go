@@ -0,0 +1,147 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	line := []byte(strings.Repeat("x", 99) + "\n")
+
+	t.Run("By size", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, LogFileName)
+		w, err := openRotatingFile(path, Rotation{MaxSize: 250, Keep: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+
+		for i := range 10 {
+			fakeNow(t, time.Date(2026, 1, 7, 10, 0, i, 0, time.UTC))
+			if _, err := w.Write(line); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		backups, _ := w.backups()
+		if len(backups) != 2 {
+			t.Fatalf("expected 2 rotated files to be kept, got %v", backups)
+		}
+		for _, backup := range append(backups, path) {
+			if info, err := os.Stat(backup); err != nil || info.Size() > 250 {
+				t.Errorf("expected %s to be at most 250 bytes, got %v (%v)", backup, info.Size(), err)
+			}
+		}
+		if filepath.Base(backups[1]) != "organise-downloads-20260107T100008.000.log" {
+			t.Errorf("expected timestamped backup names, got %v", backups)
+		}
+	})
+
+	t.Run("By age, compressed", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, LogFileName)
+		start := time.Date(2026, 1, 7, 10, 0, 0, 0, time.UTC)
+		fakeNow(t, start)
+		w, err := openRotatingFile(path, Rotation{MaxAge: 24 * time.Hour, Compress: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+
+		w.Write(line)
+		fakeNow(t, start.Add(23*time.Hour))
+		w.Write(line)
+		if backups, _ := w.backups(); len(backups) != 0 {
+			t.Fatalf("expected no rotation within a day, got %v", backups)
+		}
+		fakeNow(t, start.Add(25*time.Hour))
+		w.Write(line)
+
+		backups, _ := w.backups()
+		if len(backups) != 1 || !strings.HasSuffix(backups[0], ".log.gz") {
+			t.Fatalf("expected one compressed backup, got %v", backups)
+		}
+		f, err := os.Open(backups[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		gzipReader, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(gzipReader)
+		if err != nil || len(content) != 2*len(line) {
+			t.Errorf("expected the backup to hold 2 lines, got %d bytes (%v)", len(content), err)
+		}
+	})
+
+	t.Run("By age, left by earlier runs", func(t *testing.T) {
+		start := time.Date(2026, 1, 7, 10, 0, 0, 0, time.UTC)
+		for name, firstEntry := range map[string]string{
+			"JSON":       `{"level":"info","time":"` + start.Format(time.RFC3339) + `","message":"moved"}`,
+			"Pretty":     start.In(time.Local).Format(prettyTimeFormat) + " INF moved",
+			"Unreadable": "not a log entry",
+		} {
+			t.Run(name, func(t *testing.T) {
+				dir := t.TempDir()
+				path := filepath.Join(dir, LogFileName)
+				if err := os.WriteFile(path, []byte(firstEntry+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, start, start); err != nil {
+					t.Fatal(err)
+				}
+
+				// Each short run opens the file, writes a little and closes it again; there are no backups yet.
+				fakeNow(t, start.Add(30*24*time.Hour))
+				w, err := openRotatingFile(path, Rotation{MaxAge: 24 * time.Hour})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer w.Close()
+				w.Write(line)
+
+				if backups, _ := w.backups(); len(backups) != 1 {
+					t.Errorf("expected a log started 30 days ago to be rotated, got %v", backups)
+				}
+			})
+		}
+	})
+
+	t.Run("Rotated by another process", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, LogFileName)
+		start := time.Date(2026, 1, 7, 10, 0, 0, 0, time.UTC)
+		fakeNow(t, start)
+		w, err := openRotatingFile(path, Rotation{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+
+		w.Write(line)
+		if err := os.Rename(path, filepath.Join(dir, "organise-downloads-other.log")); err != nil {
+			t.Fatal(err)
+		}
+		fakeNow(t, start.Add(reopenCheckInterval))
+		w.Write(line)
+
+		if info, err := os.Stat(path); err != nil || info.Size() != int64(len(line)) {
+			t.Errorf("expected the log file to be reopened, got %v", err)
+		}
+	})
+}
+
+// fakeNow makes the rotating file see when as the current time.
+func fakeNow(t testing.TB, when time.Time) {
+	t.Helper()
+	now = func() time.Time { return when }
+	t.Cleanup(func() { now = time.Now })
+}
@@ -0,0 +1,141 @@
+package org
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/RMBeristain/organise-downloads/internal/common"
+)
+
+// ConflictPolicy says what MoveFiles does when a file with the same name already exists in the destination subdir.
+type ConflictPolicy string
+
+const (
+	ConflictSkip             ConflictPolicy = "skip"               // leave the file where it is
+	ConflictRename           ConflictPolicy = "rename"             // move it as 'name (2).ext', 'name (3).ext', ...
+	ConflictOverwriteIfNewer ConflictPolicy = "overwrite-if-newer" // replace the destination if the file is newer
+	ConflictKeepBothByHash   ConflictPolicy = "keep-both-by-hash"  // delete the file if it's identical, else rename it
+)
+
+// maxRenameAttempts is the highest numbered suffix tried before falling back to a timestamp.
+const maxRenameAttempts = 999
+
+// ConflictPolicies holds the default policy and any per-subdir overrides.
+type ConflictPolicies struct {
+	Default  ConflictPolicy
+	BySubdir map[string]ConflictPolicy // keyed by category name or '<ext>_files' subdir
+}
+
+// ParseConflictPolicy converts a value read from TOML into a ConflictPolicy. An empty value means ConflictSkip.
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(value); policy {
+	case "":
+		return ConflictSkip, nil
+	case ConflictSkip, ConflictRename, ConflictOverwriteIfNewer, ConflictKeepBothByHash:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q (expected %q, %q, %q or %q)",
+		value, ConflictSkip, ConflictRename, ConflictOverwriteIfNewer, ConflictKeepBothByHash)
+}
+
+// NewConflictPolicies builds the ConflictPolicies described by a loaded TOML config.
+func NewConflictPolicies(config common.Config) (ConflictPolicies, error) {
+	defaultPolicy, err := ParseConflictPolicy(config.OnConflict)
+	if err != nil {
+		return ConflictPolicies{}, err
+	}
+
+	policies := ConflictPolicies{Default: defaultPolicy, BySubdir: make(map[string]ConflictPolicy)}
+	for subDir, value := range config.OnConflictByCategory {
+		policy, err := ParseConflictPolicy(value)
+		if err != nil {
+			return ConflictPolicies{}, fmt.Errorf("category %q: %w", subDir, err)
+		}
+		policies.BySubdir[subDir] = policy
+	}
+	return policies, nil
+}
+
+// For returns the policy that applies to files moving into subDir.
+func (policies ConflictPolicies) For(subDir string) ConflictPolicy {
+	if policy, ok := policies.BySubdir[subDir]; ok {
+		return policy
+	}
+	if policies.Default == "" {
+		return ConflictSkip
+	}
+	return policies.Default
+}
+
+// resolveConflict decides what to do with srcFilePath when dstFilePath already exists. It returns the path the file
+// should be moved to, which is only different from dstFilePath when the outcome is OutcomeRename. pathExists tells
+// whether a name in the destination subdir is taken. The only error from comparing contents that isn't about the files
+// is ctx's.
+func resolveConflict(
+	ctx context.Context, policy ConflictPolicy, srcFilePath, dstFilePath string, pathExists func(path string) (bool, error),
+) (Outcome, string, error) {
+	return resolveConflictWith(ctx, policy, srcFilePath, dstFilePath, dstFilePath, pathExists)
+}
+
+// resolveConflictWith is resolveConflict for when the file at dstFilePath isn't there yet, but will be by the time
+// srcFilePath is moved: it's compared with existingFilePath, the file that will have been moved there.
+func resolveConflictWith(
+	ctx context.Context, policy ConflictPolicy, srcFilePath, dstFilePath, existingFilePath string,
+	pathExists func(path string) (bool, error),
+) (Outcome, string, error) {
+	switch policy {
+	case ConflictRename:
+		return renamedPath(dstFilePath, pathExists)
+
+	case ConflictOverwriteIfNewer:
+		srcInfo, err := os.Stat(srcFilePath)
+		if err != nil {
+			return "", "", err
+		}
+		dstInfo, err := os.Stat(existingFilePath)
+		if err != nil {
+			return "", "", err
+		}
+		if srcInfo.ModTime().After(dstInfo.ModTime()) {
+			return OutcomeOverwrite, dstFilePath, nil
+		}
+
+	case ConflictKeepBothByHash:
+		identical, err := common.SameContents(ctx, srcFilePath, existingFilePath)
+		if err != nil {
+			return "", "", err
+		}
+		if identical {
+			return OutcomeRemoveDuplicate, dstFilePath, nil
+		}
+		return renamedPath(dstFilePath, pathExists)
+	}
+
+	return OutcomeSkipConflict, dstFilePath, nil
+}
+
+// renamedPath returns the first name in the form 'name (N).ext', starting from N=2, that pathExists says is free. If
+// they're all taken, it falls back to a timestamp suffix.
+func renamedPath(dstFilePath string, pathExists func(path string) (bool, error)) (Outcome, string, error) {
+	dir := filepath.Dir(dstFilePath)
+	fileExtension := filepath.Ext(dstFilePath)
+	baseName := strings.TrimSuffix(filepath.Base(dstFilePath), fileExtension)
+
+	for attempt := 2; attempt <= maxRenameAttempts; attempt++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", baseName, attempt, fileExtension))
+		exists, err := pathExists(candidate)
+		if err != nil {
+			return "", "", err
+		}
+		if !exists {
+			return OutcomeRename, candidate, nil
+		}
+	}
+
+	candidate := filepath.Join(dir, fmt.Sprintf("%s (%s)%s", baseName, time.Now().Format("20060102-150405.000000000"), fileExtension))
+	return OutcomeRename, candidate, nil
+}
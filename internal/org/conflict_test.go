@@ -0,0 +1,164 @@
+package org
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RMBeristain/organise-downloads/internal/common"
+	"github.com/RMBeristain/organise-downloads/internal/journal"
+)
+
+func TestNewConflictPolicies(t *testing.T) {
+	policies, err := NewConflictPolicies(common.Config{
+		OnConflict:           "rename",
+		OnConflictByCategory: map[string]string{"Images": "keep-both-by-hash"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if policy := policies.For("Images"); policy != ConflictKeepBothByHash {
+		t.Errorf("expected per-category policy, got %q", policy)
+	}
+	if policy := policies.For("txt_files"); policy != ConflictRename {
+		t.Errorf("expected default policy, got %q", policy)
+	}
+	if policy := (ConflictPolicies{}).For("txt_files"); policy != ConflictSkip {
+		t.Errorf("expected zero value to skip, got %q", policy)
+	}
+
+	if _, err := NewConflictPolicies(common.Config{OnConflict: "clobber"}); err == nil {
+		t.Error("expected error for unknown policy, got nil")
+	}
+	if _, err := NewConflictPolicies(common.Config{OnConflictByCategory: map[string]string{"Images": "x"}}); err == nil {
+		t.Error("expected error for unknown per-category policy, got nil")
+	}
+}
+
+func TestMoveFiles_ConflictPolicies(t *testing.T) {
+	older := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name         string
+		policy       ConflictPolicy
+		srcContent   string
+		dstContent   string
+		dstIsNewer   bool
+		expectSrc    bool              // whether report.pdf is still in the source dir
+		expectAction Action            // what MoveFiles reports it did with report.pdf
+		expectFiles  map[string]string // files expected in the subdir, and their contents
+	}{
+		{
+			name: "Skip", policy: ConflictSkip, srcContent: "new", dstContent: "old",
+			expectSrc: true, expectAction: ActionSkipped, expectFiles: map[string]string{"report.pdf": "old"},
+		},
+		{
+			name: "Rename", policy: ConflictRename, srcContent: "new", dstContent: "old",
+			expectAction: ActionMoved, expectFiles: map[string]string{"report.pdf": "old", "report (2).pdf": "new"},
+		},
+		{
+			name: "Overwrite if newer", policy: ConflictOverwriteIfNewer, srcContent: "new", dstContent: "old",
+			expectAction: ActionMoved, expectFiles: map[string]string{"report.pdf": "new"},
+		},
+		{
+			name: "Don't overwrite if older", policy: ConflictOverwriteIfNewer, srcContent: "new", dstContent: "old",
+			dstIsNewer: true, expectSrc: true, expectAction: ActionSkipped,
+			expectFiles: map[string]string{"report.pdf": "old"},
+		},
+		{
+			name: "Identical content is removed", policy: ConflictKeepBothByHash, srcContent: "same", dstContent: "same",
+			expectAction: ActionRemoved, expectFiles: map[string]string{"report.pdf": "same"},
+		},
+		{
+			name: "Different content is kept", policy: ConflictKeepBothByHash, srcContent: "new", dstContent: "old",
+			expectAction: ActionMoved, expectFiles: map[string]string{"report.pdf": "old", "report (2).pdf": "new"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			subDir := filepath.Join(tmpDir, "pdf_files")
+			if err := os.Mkdir(subDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			srcFilePath := filepath.Join(tmpDir, "report.pdf")
+			dstFilePath := filepath.Join(subDir, "report.pdf")
+			if err := os.WriteFile(srcFilePath, []byte(tt.srcContent), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(dstFilePath, []byte(tt.dstContent), 0644); err != nil {
+				t.Fatal(err)
+			}
+			olderFilePath := dstFilePath
+			if tt.dstIsNewer {
+				olderFilePath = srcFilePath
+			}
+			if err := os.Chtimes(olderFilePath, older, older); err != nil {
+				t.Fatal(err)
+			}
+
+			journalPath := filepath.Join(t.TempDir(), journal.FileName)
+			moveJournal, err := journal.Open(journalPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results := make(chan MoveResult, 1)
+			options := MoveOptions{OnConflict: ConflictPolicies{Default: tt.policy}, Journal: moveJournal}
+			MoveFiles(context.Background(), tmpDir, map[string][]string{"pdf_files": {"report.pdf"}}, results, options)
+			moveJournal.Close()
+
+			if result := <-results; result.Action != tt.expectAction {
+				t.Errorf("expected action %q, got %+v", tt.expectAction, result)
+			}
+			// Only moves are journalled: a removed duplicate has nothing for undo to put back.
+			entries, err := journal.ReadEntries(journalPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectEntries := 0
+			if tt.expectAction == ActionMoved {
+				expectEntries = 1
+			}
+			if len(entries) != expectEntries {
+				t.Errorf("expected %d journal entries, got %v", expectEntries, entries)
+			}
+			if _, err := os.Stat(srcFilePath); (err == nil) != tt.expectSrc {
+				t.Errorf("expected source to exist=%v, got %v", tt.expectSrc, err)
+			}
+			files, err := os.ReadDir(subDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(tt.expectFiles) {
+				t.Errorf("expected %d file(s) in subdir, got %v", len(tt.expectFiles), files)
+			}
+			for name, expectedContent := range tt.expectFiles {
+				content, err := os.ReadFile(filepath.Join(subDir, name))
+				if err != nil {
+					t.Errorf("expected %s in subdir, got %v", name, err)
+				} else if string(content) != expectedContent {
+					t.Errorf("expected %s to contain %q, got %q", name, expectedContent, content)
+				}
+			}
+		})
+	}
+}
+
+func TestRenamedPath(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"report.pdf", "report (2).pdf"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outcome, path, err := renamedPath(filepath.Join(tmpDir, "report.pdf"), common.PathExists)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if outcome != OutcomeRename || filepath.Base(path) != "report (3).pdf" {
+		t.Errorf("expected 'report (3).pdf', got %q (%v)", path, outcome)
+	}
+}
@@ -0,0 +1,33 @@
+package org
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/RMBeristain/organise-downloads/internal/dedupe"
+)
+
+// FindDuplicates looks for identical files among the files in sourcePath that could be moved, including those in its
+// subdirs if rules.MaxDepth is set, and the files already in its '<ext>_files' and category subdirs. workers files are
+// hashed in parallel, until ctx is done.
+func FindDuplicates(
+	ctx context.Context, sourcePath string, files []fs.DirEntry, rules Rules, workers int,
+) ([]dedupe.Group, error) {
+	var rootFiles, subDirs []string
+	for _, file := range files {
+		if file.IsDir() && rules.isSubdir(sourcePath, file.Name()) {
+			subDirs = append(subDirs, filepath.Join(sourcePath, file.Name()))
+		}
+	}
+	files, err := rules.withNestedFiles(ctx, newDirWalker(sourcePath), files)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if fileName := file.Name(); file.Type().IsRegular() && !rules.isExcluded(fileName) {
+			rootFiles = append(rootFiles, fileName)
+		}
+	}
+	return dedupe.Scan(ctx, sourcePath, rootFiles, subDirs, workers)
+}
@@ -0,0 +1,164 @@
+package org
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/RMBeristain/organise-downloads/internal/common"
+)
+
+// listThreshold is how many files must be bound for a subdir before its names are read into memory. Below it, a stat
+// per name is cheaper than listing a subdir that may hold thousands of files.
+const listThreshold = 16
+
+// batch is a subdir that files are moved into. A batch is handled by one worker at a time, so its dir is created at
+// most once, and name conflicts inside it are resolved one file at a time.
+//
+// Once more than listThreshold files have been bound for the subdir, its names are read, and kept up to date as files
+// are moved in, so conflicts are found in memory rather than with a stat per file. Another process can still create a
+// file there in the meantime: the rename itself refuses to replace it, and the file is checked again on disk.
+type batch struct {
+	subDir     string
+	dstSubDir  string
+	names      map[string]bool // the entries of dstSubDir; nil until it's listed, or if it couldn't be
+	listed     bool            // whether listing dstSubDir was tried
+	fileCount  int             // how many files have been bound for the subdir so far
+	dirChecked bool            // whether dstSubDir has been created, or found to exist, or failed to be created
+	dirErr     error           // why dstSubDir couldn't be created
+	dirCreated bool            // whether dstSubDir was created, and no move into it has been journalled yet
+	stats      MoveStats
+
+	mu      sync.Mutex
+	pending [][]string // chunks of files waiting for the worker that has the batch, in the order they arrived
+	busy    bool       // whether a worker has the batch, or it's on its way to one
+}
+
+// enqueue adds files to those waiting to be moved into the batch's subdir. It returns true if no worker has the batch,
+// in which case the caller must hand it to one.
+func (this *batch) enqueue(files []string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.pending = append(this.pending, files)
+	if this.busy {
+		return false
+	}
+	this.busy = true
+	return true
+}
+
+// next returns the next chunk of files waiting for the batch. Once there are none it returns false, and the worker
+// must let the batch go.
+func (this *batch) next() ([]string, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if len(this.pending) == 0 {
+		this.busy = false
+		return nil, false
+	}
+	files := this.pending[0]
+	this.pending = this.pending[1:]
+	return files, true
+}
+
+// list reads the names in the batch's subdir, the first time it's called once more than listThreshold files are bound
+// for it. A subdir that doesn't exist yet has no names. Until it's read, or if it can't be, names stays nil and every
+// check goes to disk.
+func (this *batch) list() {
+	if this.listed || this.fileCount <= listThreshold {
+		return
+	}
+	this.listed = true
+
+	dir, err := os.Open(this.dstSubDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		this.names = make(map[string]bool)
+		return
+	} else if err != nil {
+		return
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return
+	}
+	this.stats.DirsListed++
+	this.names = make(map[string]bool, len(names))
+	for _, name := range names {
+		this.names[name] = true
+	}
+	this.dirChecked = true // it's there, since it could be read
+}
+
+// pathExists tells whether dstFilePath, which is in the batch's subdir or below it, is taken. Only names directly in the
+// subdir are kept in memory.
+func (this *batch) pathExists(dstFilePath string) (bool, error) {
+	this.list()
+	if this.names == nil || filepath.Dir(dstFilePath) != this.dstSubDir {
+		this.stats.DiskLookups++
+		return common.PathExists(dstFilePath)
+	}
+	this.stats.MemoryLookups++
+	return this.names[filepath.Base(dstFilePath)], nil
+}
+
+// checkOnDisk is pathExists for a name the set was wrong about: it stats dstFilePath, and adds it to the set if it's
+// taken after all.
+func (this *batch) checkOnDisk(dstFilePath string) (bool, error) {
+	this.stats.DiskLookups++
+	exists, err := common.PathExists(dstFilePath)
+	if exists {
+		this.add(dstFilePath)
+	}
+	return exists, err
+}
+
+// add records that dstFilePath is now taken.
+func (this *batch) add(dstFilePath string) {
+	if this.names != nil && filepath.Dir(dstFilePath) == this.dstSubDir {
+		this.names[filepath.Base(dstFilePath)] = true
+	}
+}
+
+// ensureDir creates the batch's subdir the first time a file needs it. Later calls return the first call's error.
+func (this *batch) ensureDir() error {
+	this.list()
+	if this.dirChecked {
+		return this.dirErr
+	}
+	this.dirChecked = true
+	if this.names == nil {
+		this.dirCreated, this.dirErr = common.CreateDirIfNotExists(this.dstSubDir)
+		return this.dirErr
+	}
+
+	// Listing found no subdir, so there's no need to look again before creating it.
+	err := os.Mkdir(this.dstSubDir, 0755)
+	if errors.Is(err, fs.ErrExist) {
+		return nil // someone else created it in the meantime
+	}
+	this.dirCreated, this.dirErr = err == nil, err
+	return this.dirErr
+}
+
+// ensureParents creates the dirs between the batch's subdir and dstFilePath, for a nested file that keeps its path. It
+// returns the outermost dir it had to create, if any.
+func (this *batch) ensureParents(dstFilePath string) (createdDir string, err error) {
+	relDir, err := filepath.Rel(this.dstSubDir, filepath.Dir(dstFilePath))
+	if err != nil || relDir == "." {
+		return "", err
+	}
+	dir := this.dstSubDir
+	for _, part := range strings.Split(relDir, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		if err := os.Mkdir(dir, 0755); err == nil && createdDir == "" {
+			createdDir = dir
+		} else if err != nil && !errors.Is(err, fs.ErrExist) {
+			return createdDir, err
+		}
+	}
+	return createdDir, nil
+}
@@ -0,0 +1,103 @@
+package org
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMoveFiles_DestinationNames(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    []string // files already in txt_files; nil means it doesn't exist yet
+		appears     string   // a name another process takes in txt_files after it's listed
+		padding     int      // how many more files are moved after a.txt, b.txt and c.txt
+		expectDsts  []string
+		expectStats MoveStats
+	}{
+		{
+			name:        "Conflicts resolved in memory",
+			existing:    []string{"a.txt", "a (2).txt"},
+			padding:     listThreshold,
+			expectDsts:  []string{"a (3).txt", "b.txt", "c.txt"},
+			expectStats: MoveStats{DirsListed: 1, MemoryLookups: 5 + listThreshold},
+		},
+		{
+			name:        "Small batch checked on disk",
+			existing:    []string{"a.txt", "a (2).txt"},
+			expectDsts:  []string{"a (3).txt", "b.txt", "c.txt"},
+			expectStats: MoveStats{DiskLookups: 5},
+		},
+		{
+			name:        "New subdir",
+			padding:     listThreshold,
+			expectDsts:  []string{"a.txt", "b.txt", "c.txt"},
+			expectStats: MoveStats{MemoryLookups: 3 + listThreshold},
+		},
+		{
+			name:        "Name taken after listing",
+			existing:    []string{},
+			appears:     "b.txt",
+			padding:     listThreshold,
+			expectDsts:  []string{"a.txt", "b (2).txt", "c.txt"},
+			expectStats: MoveStats{DirsListed: 1, MemoryLookups: 3 + listThreshold, DiskLookups: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			dstSubDir := filepath.Join(tmpDir, "txt_files")
+			files := []string{"a.txt", "b.txt", "c.txt"}
+			for i := range tt.padding {
+				files = append(files, fmt.Sprintf("pad-%02d.txt", i))
+			}
+			for _, name := range files {
+				if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.existing != nil {
+				if err := os.Mkdir(dstSubDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range tt.existing {
+				if err := os.WriteFile(filepath.Join(dstSubDir, name), []byte("existing"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.appears != "" {
+				originalRenameFile := renameFile
+				renameFile = func(oldpath, newpath string, replace bool) error {
+					if filepath.Base(newpath) == tt.appears {
+						if err := os.WriteFile(newpath, []byte("other"), 0644); err != nil {
+							return err
+						}
+					}
+					return originalRenameFile(oldpath, newpath, replace)
+				}
+				t.Cleanup(func() { renameFile = originalRenameFile })
+			}
+
+			var stats MoveStats
+			options := MoveOptions{OnConflict: ConflictPolicies{Default: ConflictRename}, Stats: &stats}
+			results := make(chan MoveResult, len(files))
+			MoveFiles(context.Background(), tmpDir, map[string][]string{"txt_files": files}, results, options)
+
+			i := 0
+			for result := range results {
+				if result.Action != ActionMoved {
+					t.Errorf("expected %s to be moved, got %+v", result.File(), result)
+				} else if i < len(tt.expectDsts) && filepath.Base(result.Destination) != tt.expectDsts[i] {
+					t.Errorf("expected %s to be moved to %s, got %+v", result.File(), tt.expectDsts[i], result)
+				}
+				i++
+			}
+			if stats != tt.expectStats {
+				t.Errorf("expected %+v, got %+v", tt.expectStats, stats)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package org
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+
+	"github.com/RMBeristain/organise-downloads/internal/common"
+)
+
+// Outcome is what happens, or would happen, to a single file.
+type Outcome string
+
+const (
+	OutcomeMove            Outcome = "move"             // the file is moved into its subdir
+	OutcomeRename          Outcome = "rename"           // the file is moved into its subdir under a new name
+	OutcomeOverwrite       Outcome = "overwrite"        // the file replaces an older one with the same name
+	OutcomeRemoveDuplicate Outcome = "remove-duplicate" // an identical file is already in the subdir; this one is deleted
+	OutcomeSkipConflict    Outcome = "skip-conflict"    // a file with the same name already exists in the subdir
+	OutcomeSkipExcluded    Outcome = "skip-excluded"    // the file's extension is excluded
+	OutcomeSkipDuplicate   Outcome = "skip-duplicate"   // an identical copy of the file is kept elsewhere
+	OutcomeSkipInUse       Outcome = "skip-in-use"      // another process is using the file
+	OutcomeDeferred        Outcome = "deferred"         // the file may still be being written; it's left for a later run
+)
+
+// PlannedMove describes what MoveFiles would do with one file.
+type PlannedMove struct {
+	Source      string  `json:"src"`
+	Destination string  `json:"dst,omitempty"`
+	Outcome     Outcome `json:"outcome"`
+	Reason      string  `json:"reason,omitempty"`
+}
+
+// DryRun works out what GetFilesToMove and MoveFiles would do with files, without creating dirs or moving anything.
+//
+// Every file is reported, including excluded, deferred and duplicate ones, and nested ones if rules.MaxDepth is set;
+// the destination of a duplicate is the copy that's kept. Conflicts are resolved in the order MoveFiles would meet the
+// files, so two files bound for the same name don't both get it, but moves are reported sorted by subdir and file name
+// so the output is stable.
+func DryRun(ctx context.Context, sourcePath string, files []fs.DirEntry, rules Rules) ([]PlannedMove, error) {
+	var plannedMoves []PlannedMove
+	resetInUseCache()
+
+	files, err := rules.withNestedFiles(ctx, newDirWalker(sourcePath), files)
+	if err != nil {
+		return nil, err
+	}
+	rules.MaxDepth = 0 // files are walked already
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if rules.isExcluded(file.Name()) {
+			plannedMoves = append(plannedMoves, PlannedMove{
+				Source:  filepath.Join(sourcePath, file.Name()),
+				Outcome: OutcomeSkipExcluded,
+			})
+		} else if keep, ok := rules.Duplicates[file.Name()]; ok {
+			plannedMoves = append(plannedMoves, PlannedMove{
+				Source:      filepath.Join(sourcePath, file.Name()),
+				Destination: keep,
+				Outcome:     OutcomeSkipDuplicate,
+			})
+		}
+	}
+
+	filesToMove, deferred, err := GetFilesToMove(ctx, sourcePath, files, rules)
+	if err != nil {
+		return nil, err
+	}
+	for _, this := range deferred {
+		plannedMoves = append(plannedMoves, PlannedMove{
+			Source:  filepath.Join(sourcePath, this.File),
+			Outcome: OutcomeDeferred,
+			Reason:  this.Reason,
+		})
+	}
+
+	subDirs := make([]string, 0, len(filesToMove))
+	for subDir := range filesToMove {
+		subDirs = append(subDirs, subDir)
+	}
+	sort.Strings(subDirs)
+
+	claimed := make(map[string]string) // destinations taken by the moves planned so far, and the file moved to each
+	pathExists := func(path string) (bool, error) {
+		if _, ok := claimed[path]; ok {
+			return true, nil
+		}
+		return common.PathExists(path)
+	}
+	for _, subDir := range subDirs {
+		var subDirMoves []PlannedMove
+		for _, file := range filesToMove[subDir] {
+			srcFilePath := filepath.Join(sourcePath, file)
+			dstFilePath := destinationPath(sourcePath, subDir, file, rules.PreservePaths)
+
+			policy := rules.OnConflict.For(subDir)
+			var outcome Outcome
+			var finalDstFilePath string
+			var err error
+			if claimer, ok := claimed[dstFilePath]; ok && !isFileInUse(srcFilePath) {
+				outcome, finalDstFilePath, err = resolveConflictWith(ctx, policy, srcFilePath, dstFilePath, claimer, pathExists)
+			} else {
+				outcome, finalDstFilePath, err = checkMove(ctx, srcFilePath, dstFilePath, policy, pathExists)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("unable to check %s: %w", dstFilePath, err)
+			}
+			if outcome == OutcomeMove || outcome == OutcomeRename || outcome == OutcomeOverwrite {
+				claimed[finalDstFilePath] = srcFilePath
+			}
+			subDirMoves = append(subDirMoves, PlannedMove{
+				Source:      srcFilePath,
+				Destination: finalDstFilePath,
+				Outcome:     outcome,
+			})
+		}
+		sort.Slice(subDirMoves, func(i, j int) bool { return subDirMoves[i].Source < subDirMoves[j].Source })
+		plannedMoves = append(plannedMoves, subDirMoves...)
+	}
+	return plannedMoves, nil
+}
+
+// WritePlannedMoves prints plannedMoves to w, either as one line per file or as a JSON array.
+func WritePlannedMoves(w io.Writer, plannedMoves []PlannedMove, asJSON bool) error {
+	if asJSON {
+		if plannedMoves == nil {
+			plannedMoves = []PlannedMove{} // print '[]' rather than 'null'
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plannedMoves)
+	}
+
+	for _, this := range plannedMoves {
+		var err error
+		switch {
+		case this.Reason != "":
+			_, err = fmt.Fprintf(w, "%-16s %s (%s)\n", this.Outcome, this.Source, this.Reason)
+		case this.Destination == "":
+			_, err = fmt.Fprintf(w, "%-16s %s\n", this.Outcome, this.Source)
+		default:
+			_, err = fmt.Fprintf(w, "%-16s %s -> %s\n", this.Outcome, this.Source, this.Destination)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
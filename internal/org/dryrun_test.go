@@ -0,0 +1,164 @@
+package org
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"new.txt", "conflict.txt", "movie.part"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(tmpDir, "txt_files"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "txt_files", "conflict.txt"), []byte("dest"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plannedMoves, err := DryRun(context.Background(), tmpDir, files, Rules{ExcludedExtensions: []string{".part"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]Outcome{
+		"movie.part":   OutcomeSkipExcluded,
+		"conflict.txt": OutcomeSkipConflict,
+		"new.txt":      OutcomeMove,
+	}
+	if len(plannedMoves) != len(expected) {
+		t.Fatalf("expected %d planned moves, got %v", len(expected), plannedMoves)
+	}
+	for _, this := range plannedMoves {
+		if outcome := expected[filepath.Base(this.Source)]; outcome != this.Outcome {
+			t.Errorf("expected %s to be %q, got %q", this.Source, outcome, this.Outcome)
+		}
+	}
+
+	// Nothing may have moved.
+	if _, err := os.Stat(filepath.Join(tmpDir, "new.txt")); err != nil {
+		t.Errorf("expected source file to still exist, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "txt_files", "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected destination file to not exist, got %v", err)
+	}
+
+	t.Run("Text output", func(t *testing.T) {
+		var output bytes.Buffer
+		if err := WritePlannedMoves(&output, plannedMoves, false); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+		if len(lines) != len(plannedMoves) {
+			t.Fatalf("expected one line per file, got %q", output.String())
+		}
+		if !strings.Contains(output.String(), "move             "+filepath.Join(tmpDir, "new.txt")+" -> ") {
+			t.Errorf("expected a 'move' line for new.txt, got %q", output.String())
+		}
+	})
+
+	t.Run("JSON output", func(t *testing.T) {
+		var output bytes.Buffer
+		if err := WritePlannedMoves(&output, plannedMoves, true); err != nil {
+			t.Fatal(err)
+		}
+		var decoded []PlannedMove
+		if err := json.Unmarshal(output.Bytes(), &decoded); err != nil {
+			t.Fatalf("expected valid JSON, got %v", err)
+		}
+		if len(decoded) != len(plannedMoves) {
+			t.Errorf("expected %d entries, got %d", len(plannedMoves), len(decoded))
+		}
+	})
+}
+
+func TestDryRun_NoDirsCreated(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "a.pdf"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DryRun(context.Background(), tmpDir, files, Rules{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "pdf_files")); !os.IsNotExist(err) {
+		t.Errorf("expected 'pdf_files' to not be created, got %v", err)
+	}
+}
+
+func TestDryRun_Recursive(t *testing.T) {
+	tmpDir := t.TempDir()
+	for name, contents := range map[string]string{
+		"x.pdf": "root", "a/x.pdf": "same", "b/x.pdf": "same", "a/skip.tmp": "excluded",
+	} {
+		path := filepath.Join(tmpDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The files are met in the order they're walked: a/x.pdf, b/x.pdf, then x.pdf.
+	tests := []struct {
+		policy ConflictPolicy
+		expect map[string]string // source, relative to tmpDir -> outcome and destination name
+	}{
+		{ConflictRename, map[string]string{
+			"a/x.pdf": "move x.pdf", "b/x.pdf": "rename x (2).pdf", "x.pdf": "rename x (3).pdf", "a/skip.tmp": "skip-excluded",
+		}},
+		{ConflictKeepBothByHash, map[string]string{
+			"a/x.pdf": "move x.pdf", "b/x.pdf": "remove-duplicate x.pdf", "x.pdf": "rename x (2).pdf",
+			"a/skip.tmp": "skip-excluded",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			rules := Rules{
+				ExcludedExtensions: []string{".tmp"}, MaxDepth: 2, OnConflict: ConflictPolicies{Default: tt.policy},
+			}
+			plannedMoves, err := DryRun(context.Background(), tmpDir, files, rules)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := make(map[string]string)
+			for _, this := range plannedMoves {
+				relPath, _ := filepath.Rel(tmpDir, this.Source)
+				got[filepath.ToSlash(relPath)] = string(this.Outcome)
+				if this.Destination != "" {
+					got[filepath.ToSlash(relPath)] += " " + filepath.Base(this.Destination)
+				}
+			}
+			if len(got) != len(tt.expect) {
+				t.Fatalf("expected %v, got %v", tt.expect, got)
+			}
+			for source, expected := range tt.expect {
+				if got[source] != expected {
+					t.Errorf("expected %s to be %q, got %q", source, expected, got[source])
+				}
+			}
+		})
+	}
+}
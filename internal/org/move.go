@@ -0,0 +1,155 @@
+package org
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/RMBeristain/organise-downloads/internal/common"
+)
+
+// renameFile renames oldpath to newpath. Unless replace is true it fails with an error matching fs.ErrExist, rather
+// than overwriting newpath, if newpath already exists. Tests replace it to simulate moves across filesystems.
+var renameFile = func(oldpath, newpath string, replace bool) error {
+	if replace {
+		return os.Rename(oldpath, newpath)
+	}
+	return renameNoReplace(oldpath, newpath)
+}
+
+// isCrossDevice returns whether err is the error rename returns when source and destination are on different mounts.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errCrossDevice)
+}
+
+// moveFile moves srcFilePath to dstFilePath. An existing dstFilePath is only replaced if replace is true; otherwise
+// the error matches fs.ErrExist. If they're on different filesystems, where a rename isn't possible, the file is
+// copied instead, and the source is only deleted once the copy is safely in place. If options.VerifyCopyHash is true
+// the copy's SHA-256 must also match the source's. If ctx is done during the copy, the copy is deleted and the source is
+// left where it was.
+func (options MoveOptions) moveFile(ctx context.Context, srcFilePath, dstFilePath string, replace bool) error {
+	err := renameFile(srcFilePath, dstFilePath, replace)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	options.Logger.Debug().Str("srcFilePath", srcFilePath).Str("dstFilePath", dstFilePath).
+		Msg("destination is on another filesystem; copying instead")
+	return copyAndDelete(ctx, srcFilePath, dstFilePath, replace, options.VerifyCopyHash)
+}
+
+// MoveNoReplace moves srcFilePath to dstFilePath the way a run does, for moves that aren't part of one, such as undo.
+// It never replaces an existing dstFilePath. Across filesystems the file is copied, the copy's SHA-256 is checked, and
+// only then is the source deleted.
+func MoveNoReplace(ctx context.Context, srcFilePath, dstFilePath string) error {
+	return MoveOptions{VerifyCopyHash: true}.moveFile(ctx, srcFilePath, dstFilePath, false)
+}
+
+// renameNoReplaceFallback is the portable, but racy, version of renameNoReplace: another process can still create
+// newpath between the check and the rename.
+func renameNoReplaceFallback(oldpath, newpath string) error {
+	if _, err := os.Lstat(newpath); err == nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+// copyAndDelete streams srcFilePath into a temp file next to dstFilePath, syncs and verifies it, gives it the source's
+// mode and mtime, renames it into place and finally deletes the source. Until the temp file is renamed, ctx being done
+// stops the copy and removes the temp file.
+func copyAndDelete(ctx context.Context, srcFilePath, dstFilePath string, replace, verifyHash bool) (err error) {
+	src, err := os.Open(srcFilePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dstFilePath), ".organise-downloads-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	var srcHash hash.Hash
+	var reader io.Reader = common.ContextReader{Ctx: ctx, Reader: src}
+	if verifyHash {
+		srcHash = sha256.New()
+		reader = io.TeeReader(reader, srcHash)
+	}
+	written, err := io.Copy(tmp, reader)
+	if err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if written != srcInfo.Size() {
+		return fmt.Errorf("copied %d bytes of %s, expected %d", written, srcFilePath, srcInfo.Size())
+	}
+	if verifyHash {
+		if err = verifyCopy(tmp, srcHash.Sum(nil)); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	if err = os.Chmod(tmpPath, srcInfo.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = os.Chtimes(tmpPath, srcInfo.ModTime(), srcInfo.ModTime()); err != nil {
+		return err
+	}
+	if replace {
+		err = os.Rename(tmpPath, dstFilePath)
+	} else {
+		err = renameNoReplace(tmpPath, dstFilePath)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The copy is in place; from here on the source must not be deleted on failure, nor the copy.
+	src.Close()
+	if removeErr := os.Remove(srcFilePath); removeErr != nil {
+		return fmt.Errorf("copied to %s but unable to delete the source: %w", dstFilePath, removeErr)
+	}
+	return nil
+}
+
+// verifyCopy re-reads tmp from the start and compares its SHA-256 with expected.
+func verifyCopy(tmp *os.File, expected []byte) error {
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tmpHash := sha256.New()
+	if _, err := io.Copy(tmpHash, tmp); err != nil {
+		return err
+	}
+	if string(tmpHash.Sum(nil)) != string(expected) {
+		return fmt.Errorf("copy of %s doesn't match the source", tmp.Name())
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package org
+
+import "syscall"
+
+// errCrossDevice is returned by os.Rename when the destination is on another filesystem.
+var errCrossDevice error = syscall.EXDEV
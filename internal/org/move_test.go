@@ -0,0 +1,277 @@
+package org
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RMBeristain/organise-downloads/internal/journal"
+)
+
+// simulateCrossDevice makes the first rename of every move fail the way it does across filesystems.
+func simulateCrossDevice(t *testing.T) {
+	t.Helper()
+	originalRenameFile := renameFile
+	renameFile = func(oldpath, newpath string, _ bool) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errCrossDevice}
+	}
+	t.Cleanup(func() { renameFile = originalRenameFile })
+}
+
+// moveBack is how undo moves files back.
+func moveBack(source, destination string) error {
+	return MoveNoReplace(context.Background(), source, destination)
+}
+
+func TestMoveFile_CrossDevice(t *testing.T) {
+	simulateCrossDevice(t)
+
+	for _, verifyHash := range []bool{false, true} {
+		tmpDir := t.TempDir()
+		srcFilePath := filepath.Join(tmpDir, "big.iso")
+		dstFilePath := filepath.Join(tmpDir, "iso_files", "big.iso")
+		if err := os.Mkdir(filepath.Dir(dstFilePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		content := make([]byte, 1<<20)
+		for i := range content {
+			content[i] = byte(i)
+		}
+		if err := os.WriteFile(srcFilePath, content, 0640); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+		if err := os.Chtimes(srcFilePath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := (MoveOptions{VerifyCopyHash: verifyHash}).moveFile(context.Background(), srcFilePath, dstFilePath, false); err != nil {
+			t.Fatalf("unexpected error (verifyHash=%v): %v", verifyHash, err)
+		}
+
+		if _, err := os.Stat(srcFilePath); !os.IsNotExist(err) {
+			t.Errorf("expected source to be deleted, got %v", err)
+		}
+		info, err := os.Stat(dstFilePath)
+		if err != nil {
+			t.Fatalf("expected destination to exist, got %v", err)
+		}
+		if info.Size() != int64(len(content)) {
+			t.Errorf("expected %d bytes, got %d", len(content), info.Size())
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("expected mtime %v to be preserved, got %v", mtime, info.ModTime())
+		}
+		leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(dstFilePath), ".organise-downloads-*"))
+		if len(leftovers) != 0 {
+			t.Errorf("expected no temp files to be left behind, got %v", leftovers)
+		}
+	}
+}
+
+func TestMoveFile_CrossDeviceFailure(t *testing.T) {
+	simulateCrossDevice(t)
+
+	tmpDir := t.TempDir()
+	srcFilePath := filepath.Join(tmpDir, "file.txt")
+	if err := os.WriteFile(srcFilePath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The destination dir doesn't exist, so the copy can't even start.
+	dstFilePath := filepath.Join(tmpDir, "missing", "file.txt")
+	if err := (MoveOptions{VerifyCopyHash: true}).moveFile(context.Background(), srcFilePath, dstFilePath, false); err == nil {
+		t.Error("expected error, got nil")
+	}
+	if _, err := os.Stat(srcFilePath); err != nil {
+		t.Errorf("expected source to be kept after a failed copy, got %v", err)
+	}
+}
+
+func TestMoveFile_CrossDeviceCancelled(t *testing.T) {
+	simulateCrossDevice(t)
+
+	tmpDir := t.TempDir()
+	srcFilePath := filepath.Join(tmpDir, "file.txt")
+	dstFilePath := filepath.Join(tmpDir, "txt_files", "file.txt")
+	if err := os.WriteFile(srcFilePath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Dir(dstFilePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := (MoveOptions{}).moveFile(ctx, srcFilePath, dstFilePath, false); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(srcFilePath); err != nil {
+		t.Errorf("expected source to be kept, got %v", err)
+	}
+	if leftovers, _ := os.ReadDir(filepath.Dir(dstFilePath)); len(leftovers) != 0 {
+		t.Errorf("expected the copy to be rolled back, got %v", leftovers)
+	}
+}
+
+func TestUndo_CrossDevice(t *testing.T) {
+	simulateCrossDevice(t)
+
+	tmpDir := t.TempDir()
+	srcFilePath := filepath.Join(tmpDir, "big.iso")
+	if err := os.WriteFile(srcFilePath, []byte("big"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	journalPath := filepath.Join(t.TempDir(), journal.FileName)
+	moveJournal, err := journal.Open(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { moveJournal.Close() })
+
+	results := make(chan MoveResult, 1)
+	MoveFiles(context.Background(), tmpDir, map[string][]string{"iso_files": {"big.iso"}}, results,
+		MoveOptions{Journal: moveJournal})
+	if result := <-results; result.Action != ActionMoved {
+		t.Fatalf("expected big.iso to be copied across, got %+v", result)
+	}
+
+	// The way back crosses filesystems too, so it has to be copied back.
+	entries, err := journal.ReadEntries(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	undone, err := journal.Undo(moveJournal, entries, moveJournal.RunID(), moveBack)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(undone) != 1 || !undone[0].Restored {
+		t.Fatalf("expected big.iso to be restored, got %+v", undone)
+	}
+	if _, err := os.Stat(srcFilePath); err != nil {
+		t.Errorf("expected big.iso to be back, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "iso_files")); !os.IsNotExist(err) {
+		t.Errorf("expected iso_files to be removed, got %v", err)
+	}
+}
+
+func TestMoveFiles_Cancelled(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFilePath := filepath.Join(tmpDir, "report.pdf")
+	if err := os.WriteFile(srcFilePath, []byte("report"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results := make(chan MoveResult, 1)
+	MoveFiles(ctx, tmpDir, map[string][]string{"pdf_files": {"report.pdf"}}, results, MoveOptions{})
+
+	if result, ok := <-results; ok {
+		t.Errorf("expected no results once cancelled, got %+v", result)
+	}
+	if _, err := os.Stat(srcFilePath); err != nil {
+		t.Errorf("expected the file to be left alone, got %v", err)
+	}
+}
+
+func TestRenameNoReplace(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFilePath := filepath.Join(tmpDir, "new.txt")
+	dstFilePath := filepath.Join(tmpDir, "taken.txt")
+	for path, content := range map[string]string{srcFilePath: "new", dstFilePath: "old"} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := renameNoReplace(srcFilePath, dstFilePath); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected an error matching fs.ErrExist, got %v", err)
+	}
+	if content, _ := os.ReadFile(dstFilePath); string(content) != "old" {
+		t.Errorf("expected destination to be left alone, got %q", content)
+	}
+
+	freeFilePath := filepath.Join(tmpDir, "free.txt")
+	if err := renameNoReplace(srcFilePath, freeFilePath); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content, _ := os.ReadFile(freeFilePath); string(content) != "new" {
+		t.Errorf("expected file to be renamed, got %q", content)
+	}
+}
+
+func TestMoveFiles_DestinationAppears(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFilePath := filepath.Join(tmpDir, "report.pdf")
+	dstFilePath := filepath.Join(tmpDir, "pdf_files", "report.pdf")
+	if err := os.WriteFile(srcFilePath, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process creates the destination between checkMove and the rename.
+	originalRenameFile := renameFile
+	renameFile = func(oldpath, newpath string, replace bool) error {
+		if err := os.WriteFile(newpath, []byte("other"), 0644); err != nil {
+			return err
+		}
+		return originalRenameFile(oldpath, newpath, replace)
+	}
+	t.Cleanup(func() { renameFile = originalRenameFile })
+
+	results := make(chan MoveResult, 1)
+	MoveFiles(context.Background(), tmpDir, map[string][]string{"pdf_files": {"report.pdf"}}, results, MoveOptions{})
+
+	if result := <-results; result.Action != ActionSkipped || result.Err != nil {
+		t.Errorf("expected the file to be skipped, got %+v", result)
+	}
+
+	if _, err := os.Stat(srcFilePath); err != nil {
+		t.Errorf("expected source to be kept, got %v", err)
+	}
+	if content, _ := os.ReadFile(dstFilePath); string(content) != "other" {
+		t.Errorf("expected the other process's file to be left alone, got %q", content)
+	}
+}
+
+func TestMoveFiles_Results(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"stuck.pdf", "fine.pdf"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	originalRenameFile := renameFile
+	renameFile = func(oldpath, newpath string, replace bool) error {
+		if filepath.Base(oldpath) == "stuck.pdf" {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrPermission}
+		}
+		return originalRenameFile(oldpath, newpath, replace)
+	}
+	t.Cleanup(func() { renameFile = originalRenameFile })
+
+	results := make(chan MoveResult, 2)
+	MoveFiles(context.Background(), tmpDir, map[string][]string{"pdf_files": {"stuck.pdf", "fine.pdf"}}, results, MoveOptions{})
+
+	byFile := make(map[string]MoveResult)
+	for result := range results {
+		byFile[result.File()] = result
+	}
+	stuck := byFile["stuck.pdf"]
+	if stuck.Action != ActionFailed || !errors.Is(stuck.Err, fs.ErrPermission) || !stuck.Retryable() {
+		t.Errorf("expected stuck.pdf to fail and be retryable, got %+v", stuck)
+	}
+	fine := byFile["fine.pdf"]
+	if fine.Action != ActionMoved || fine.Reason != string(OutcomeMove) || fine.Retryable() {
+		t.Errorf("expected fine.pdf to be moved, got %+v", fine)
+	}
+	if fine.Destination != filepath.Join(tmpDir, "pdf_files", "fine.pdf") || fine.Bytes != int64(len("fine.pdf")) {
+		t.Errorf("unexpected destination or size: %+v", fine)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package org
+
+import "syscall"
+
+// errCrossDevice is ERROR_NOT_SAME_DEVICE, returned by os.Rename when the destination is on another volume.
+var errCrossDevice error = syscall.Errno(17)
@@ -2,90 +2,462 @@
 package org
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/RMBeristain/organise-downloads/internal/common"
-	"github.com/RMBeristain/organise-downloads/internal/logging"
+	"github.com/RMBeristain/organise-downloads/internal/dedupe"
+	"github.com/RMBeristain/organise-downloads/internal/detect"
+	"github.com/RMBeristain/organise-downloads/internal/journal"
 	"github.com/RMBeristain/organise-downloads/local_utils"
+	"github.com/rs/zerolog"
 )
 
-var (
-	contains = local_utils.Contains
-	logger   = &logging.ConfiguredZerologger
-)
+var contains = local_utils.Contains
+
+// ErrInUse is the Err of a deferred MoveResult for a file that another process is using.
+var ErrInUse = errors.New("file is in use")
+
+// Rules decide which files are moved and which subdir each of them is moved into.
+type Rules struct {
+	ExcludedExtensions []string             // file or dir names that must not be moved
+	Categories         common.CategoryIndex // extensions that share a named folder; others go to '<ext>_files'
+	ContentDetection   detect.Mode          // whether file contents are read to find the real type
+	OnConflict         ConflictPolicies     // what to do when a file with the same name is already in the subdir
+	Dedupe             dedupe.Action        // whether to look for duplicates, and what to do with them
+	Duplicates         map[string]string    // files that must not be moved because an identical copy is kept elsewhere
+	VerifyCopyHash     bool                 // whether copies made across filesystems are checked by SHA-256 as well as size
+	MinAge             time.Duration        // files modified more recently than this may still be being written
+	StabilityInterval  time.Duration        // if set, younger files are sampled twice this far apart and moved if unchanged
+	PartialSuffixes    []string             // suffixes of in-progress downloads; files with such a sibling aren't moved
+	MaxDepth           int                  // how many levels of subdirs files are moved out of; 0 means only the top
+	PreservePaths      bool                 // whether nested files keep their subdirs under their category
+	Skip               func(string) bool    // if set, files it returns true for are left alone this time; nil skips none
+	Logger             zerolog.Logger       // the zero value logs nothing
+}
+
+// NewRules builds the Rules described by a loaded TOML config.
+func NewRules(config common.Config) (Rules, error) {
+	categories, err := common.NewCategoryIndex(config.Categories)
+	if err != nil {
+		return Rules{}, err
+	}
+	contentDetection, err := detect.ParseMode(config.ContentDetection)
+	if err != nil {
+		return Rules{}, err
+	}
+	onConflict, err := NewConflictPolicies(config)
+	if err != nil {
+		return Rules{}, err
+	}
+	dedupeAction, err := dedupe.ParseAction(config.Dedupe)
+	if err != nil {
+		return Rules{}, err
+	}
+	if config.MinAge < 0 || config.StabilityInterval < 0 {
+		return Rules{}, fmt.Errorf("minAge and stabilityInterval can't be negative (got %d and %d)",
+			config.MinAge, config.StabilityInterval)
+	}
+	if config.StabilityInterval > 0 && config.MinAge == 0 {
+		// Only files younger than minAge are sampled, so without it the interval would be ignored.
+		return Rules{}, fmt.Errorf("stabilityInterval needs minAge to be set (got stabilityInterval %d)",
+			config.StabilityInterval)
+	}
+	maxDepth := 0
+	if config.Recursive {
+		if config.MaxDepth < 0 {
+			return Rules{}, fmt.Errorf("maxDepth can't be negative (got %d)", config.MaxDepth)
+		}
+		maxDepth = config.MaxDepth
+		if maxDepth == 0 {
+			maxDepth = common.DefaultMaxDepth
+		}
+	}
+	return Rules{
+		ExcludedExtensions: config.ExcludedFiles,
+		Categories:         categories,
+		ContentDetection:   contentDetection,
+		OnConflict:         onConflict,
+		Dedupe:             dedupeAction,
+		VerifyCopyHash:     config.VerifyCopyHash,
+		MinAge:             time.Duration(config.MinAge) * time.Second,
+		StabilityInterval:  time.Duration(config.StabilityInterval) * time.Second,
+		PartialSuffixes:    config.PartialSuffixes,
+		MaxDepth:           maxDepth,
+		PreservePaths:      config.PreservePaths,
+	}, nil
+}
+
+// isExcluded returns whether fileName must be left where it is.
+func (rules Rules) isExcluded(fileName string) bool {
+	return contains(rules.ExcludedExtensions, filepath.Ext(fileName))
+}
 
 // GetFilesToMove return a map of subdirs to slices of files.
 //
+// - sourcePath is the dir that contains files; it's read for content detection and the stability check.
 // - files is a slice of DirEntries that should be moved.
-// - excludedExtensions is a slice of strings containing file or dir names that must not be moved.
+// - rules holds the excluded extensions, the category folders, the content detection mode, known duplicates, how long
+// files must have been left alone and the suffixes of in-progress downloads.
 //
-// Each targets key is a destination subdir, and its value is a slice of the files that should be moved into it.
-func GetFilesToMove(files []fs.DirEntry, excludedExtensions []string) (targets map[string][]string) {
+// Each targets key is a destination subdir, and its value is a slice of the files that should be moved into it; dirs in
+// files are never targets themselves. Files that may still be being written, including placeholders next to a browser's
+// temp file, aren't in targets but in deferred, so they can be reported and picked up later. If rules.MaxDepth is set,
+// the files in the subdirs of sourcePath are classified too, and named by their paths relative to it. The only error is
+// ctx's, if it's done before every file is classified.
+func GetFilesToMove(
+	ctx context.Context, sourcePath string, files []fs.DirEntry, rules Rules,
+) (targets map[string][]string, deferred []Deferred, err error) {
+	files, err = rules.withNestedFiles(ctx, newDirWalker(sourcePath), files)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	targets = make(map[string][]string)
+	fileNames := make(map[string]bool, len(files))
+	for _, file := range files {
+		fileNames[file.Name()] = true
+	}
+
+	candidates, deferred := rules.candidates(files, func(name string) bool { return fileNames[name] })
+
+	settled, unsettled, err := rules.settledFiles(ctx, sourcePath, candidates)
+	if err != nil {
+		return nil, nil, err
+	}
+	deferred = append(deferred, unsettled...)
+	if err := rules.classify(ctx, sourcePath, settled, targets); err != nil {
+		return nil, nil, err
+	}
+	return targets, deferred, nil
+}
+
+// candidates returns the files that may be moved, leaving out dirs, excluded files, known duplicates and the files
+// rules.Skip leaves alone. Files that belong to an in-progress download are deferred; siblingExists tells whether a
+// partial download is in the dir.
+func (rules Rules) candidates(
+	files []fs.DirEntry, siblingExists func(name string) bool,
+) (candidates []fs.DirEntry, deferred []Deferred) {
 	for _, file := range files {
 		fileName := file.Name()
-		if file.IsDir() {
-			if _, ok := targets[fileName]; !ok {
-				targets[fileName] = []string{}
-				logger.Trace().Str("fileName", fileName).Msg("found dir to process")
-			}
-		} else {
-			fileExtension, destination := common.GetExtAndSubdir(fileName)
+		if file.IsDir() || rules.isExcluded(fileName) {
+			continue
+		}
+		if keep, ok := rules.Duplicates[fileName]; ok {
+			rules.Logger.Debug().Str("fileName", fileName).Str("keep", keep).Msg("skipping duplicate")
+			continue
+		}
+		if rules.Skip != nil && rules.Skip(fileName) {
+			rules.Logger.Debug().Str("fileName", fileName).Msg("skipping file for now")
+			continue
+		}
+		if reason, inProgress := rules.downloadInProgress(fileName, siblingExists); inProgress {
+			deferred = append(deferred, Deferred{File: fileName, Reason: reason})
+			continue
+		}
+		candidates = append(candidates, file)
+	}
+	return candidates, deferred
+}
 
-			if contains(excludedExtensions, fileExtension) {
-				continue
-			}
-			targets[destination] = append(targets[destination], fileName)
+// classify adds each of fileNames to the targets of its subdir. The only error is ctx's.
+func (rules Rules) classify(ctx context.Context, sourcePath string, fileNames []string, targets map[string][]string) error {
+	for _, fileName := range fileNames {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
+		fileExtension, destination := rules.Categories.GetExtAndSubdir(fileName)
+		if rules.ContentDetection != detect.ModeOff && rules.ContentDetection != "" {
+			destination = detectSubdir(sourcePath, fileName, fileExtension, destination, rules)
+		}
+		targets[destination] = append(targets[destination], fileName)
 	}
-	return targets
+	return nil
 }
 
-// MoveFiles sequentially moves each file to its corresponding directory.
-func MoveFiles(sourcePath string, filesToMove map[string][]string, fileChannel chan string) {
-	defer close(fileChannel)
-	var movedFileCount int = 0
-	var totalFileCount int = 0
+// detectSubdir returns the subdir for fileName according to its contents, or destination if detection doesn't apply.
+func detectSubdir(sourcePath, fileName, fileExtension, destination string, rules Rules) string {
+	detectedExtension, err := detect.Extension(rules.ContentDetection, filepath.Join(sourcePath, fileName))
+	if err != nil {
+		rules.Logger.Debug().Err(err).Str("fileName", fileName).Msg("unable to read file; using its extension")
+		return destination
+	}
+	if detectedExtension == fileExtension {
+		return destination
+	}
 
-	for subDir, files := range filesToMove {
-		batchSize := len(files)
-		totalFileCount += batchSize
+	rules.Logger.Debug().Str("fileName", fileName).Str("detectedExtension", detectedExtension).Msg("classified by content")
+	return rules.Categories.Subdir(detectedExtension)
+}
 
-		for i, file := range files {
-			srcFilePath := filepath.Join(sourcePath, file)
-			dstSubDir := filepath.Join(sourcePath, subDir)
-			dstFilePath := filepath.Join(dstSubDir, file)
+// destinationPath returns where file, named by its path relative to sourcePath, goes in subDir. A nested file keeps its
+// subdirs only if preservePaths is set.
+func destinationPath(sourcePath, subDir, file string, preservePaths bool) string {
+	if !preservePaths {
+		file = filepath.Base(file)
+	}
+	return filepath.Join(sourcePath, subDir, file)
+}
 
-			if i == 0 {
-				logger.Info().Int("batchSize", batchSize).Str("subDir", subDir).Msg("processing")
+// checkMove returns what MoveFiles should do with srcFilePath, and where the file should end up, without changing
+// anything. pathExists tells whether a name in the destination subdir is taken. Errors are unexpected failures to check
+// the destination, and are returned with an empty Outcome.
+func checkMove(
+	ctx context.Context, srcFilePath, dstFilePath string, policy ConflictPolicy, pathExists func(path string) (bool, error),
+) (Outcome, string, error) {
+	if isFileInUse(srcFilePath) {
+		return OutcomeSkipInUse, dstFilePath, nil
+	}
+
+	exists, err := pathExists(dstFilePath)
+	if err != nil {
+		return "", "", err
+	}
+	if exists {
+		return resolveConflict(ctx, policy, srcFilePath, dstFilePath, pathExists)
+	}
+	return OutcomeMove, dstFilePath, nil
+}
+
+// MoveOptions controls optional behaviour of MoveFiles. The zero value just moves files.
+type MoveOptions struct {
+	Journal        *journal.Journal // if set, every completed move is recorded so the run can be undone
+	OnConflict     ConflictPolicies // what to do when a file with the same name is already in the subdir
+	VerifyCopyHash bool             // whether copies made across filesystems are checked by SHA-256 as well as size
+	Workers        int              // how many subdirs are filled at once; less than 1 means 1
+	PreservePaths  bool             // whether nested files keep their subdirs under their category
+	Stats          *MoveStats       // if set, MoveStream adds how it checked the destinations, before closing results
+	Logger         zerolog.Logger   // the zero value logs nothing
+}
+
+// MoveFiles moves each file to its corresponding directory, and sends a MoveResult for every file on results, which it
+// closes when it's done. It's MoveStream with all the targets known up front, and subdirs handed out in order of their
+// names.
+func MoveFiles(
+	ctx context.Context, sourcePath string, filesToMove map[string][]string, results chan<- MoveResult,
+	options MoveOptions,
+) {
+	targets := make(chan map[string][]string, 1)
+	targets <- filesToMove
+	close(targets)
+	MoveStream(ctx, sourcePath, targets, results, options)
+}
+
+// MoveStream moves the files of each targets map that arrives, mapping subdirs to the files bound for them, while
+// later ones are still being worked out. It sends a MoveResult for every file on results, and closes results once
+// targets is closed and every file has been handled.
+//
+// Up to options.Workers subdirs are filled at once. Any idle worker takes the next subdir with files waiting, but only
+// one works on a subdir at a time, so its dir is created once and results for its files arrive in order; those of
+// different subdirs may be interleaved, and MoveResult.SubDir tells them apart. Only a few chunks of targets may be
+// waiting for a worker, so a slow move holds back whatever produces targets instead of piling them up.
+//
+// Once ctx is done no more files are started, and those left get no MoveResult. A file that's being copied across
+// filesystems at the time is rolled back, and reported as failed with ctx's error; a rename always completes. targets
+// is still drained, so whatever sends on it isn't left blocked.
+func MoveStream(
+	ctx context.Context, sourcePath string, targets <-chan map[string][]string, results chan<- MoveResult,
+	options MoveOptions,
+) {
+	defer close(results)
+	resetInUseCache()
+
+	var movedFileCount atomic.Int64
+	var wg sync.WaitGroup
+	workers := max(options.Workers, 1)
+	jobs := make(chan *batch, workers)
+	chunks := make(chan struct{}, 2*workers) // a slot for each chunk of files that's waiting or being moved
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for this := range jobs {
+				for files, ok := this.next(); ok; files, ok = this.next() {
+					movedFileCount.Add(options.moveBatch(ctx, sourcePath, this, files, results))
+					<-chunks
+				}
 			}
+		}()
+	}
 
-			if isFileInUse(srcFilePath) {
-				logger.Debug().Str("file", file).Msg("skipping file: currently in use")
-				continue
+	totalFileCount := 0
+	batches := make(map[string]*batch)
+	for filesToMove := range targets {
+		subDirs := make([]string, 0, len(filesToMove))
+		for subDir, files := range filesToMove {
+			if len(files) > 0 {
+				subDirs = append(subDirs, subDir)
+				totalFileCount += len(files)
 			}
+		}
+		sort.Strings(subDirs)
 
-			if exists, err := common.PathExists(dstFilePath); !exists && err == nil {
-				_, err := common.CreateDirIfNotExists(dstSubDir)
-				if err != nil {
-					logger.Err(err).Str("subDir", subDir).Msg("skipping batch: unable to create dir")
-					continue
-				}
-				if err := os.Rename(srcFilePath, dstFilePath); err != nil {
-					logger.Err(err).Str("file", file).Msg("skipping file: unable to rename")
-					continue
-				}
-			} else if exists {
-				logger.Err(err).Str("fileName", file).Str("dstFilePath", dstFilePath).Msg("skipped")
-			} else {
-				logger.Fatal().Err(err).Send()
+		for _, subDir := range subDirs {
+			this, ok := batches[subDir]
+			if !ok {
+				this = &batch{subDir: subDir, dstSubDir: filepath.Join(sourcePath, subDir)}
+				batches[subDir] = this
+			}
+			chunks <- struct{}{}
+			if this.enqueue(filesToMove[subDir]) {
+				jobs <- this
 			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	var stats MoveStats
+	for _, this := range batches {
+		stats.add(this.stats)
+	}
+	options.Logger.Info().Int64("dirsListed", stats.DirsListed).Int64("memoryLookups", stats.MemoryLookups).
+		Int64("diskLookups", stats.DiskLookups).Msg("checked destinations")
+	if options.Stats != nil {
+		options.Stats.add(stats)
+	}
+	if err := ctx.Err(); err != nil {
+		options.Logger.Warn().Err(err).Msg("interrupted; the remaining files weren't started")
+	}
+	options.Logger.Info().Int64("movedCount", movedFileCount.Load()).Int("totalCount", totalFileCount).Msg("moved")
+}
+
+// moveBatch moves files into the subdir of this, sends their results and returns how many were moved.
+func (options MoveOptions) moveBatch(
+	ctx context.Context, sourcePath string, this *batch, files []string, results chan<- MoveResult,
+) (movedFileCount int64) {
+	if ctx.Err() != nil {
+		return 0
+	}
+	options.Logger.Info().Int("batchSize", len(files)).Str("subDir", this.subDir).Msg("processing")
+	this.fileCount += len(files)
+	for i, file := range files {
+		if ctx.Err() != nil {
+			return movedFileCount
+		}
+		result := options.moveOne(ctx, sourcePath, this, file, false)
+		if result.Action == ActionMoved {
 			movedFileCount += 1
-			logger.Debug().Int("count", i+1).Str("srcFilePath", srcFilePath).Str("dstFilePath", dstFilePath).Msg("moved")
-			fileChannel <- dstFilePath
+			options.Logger.Debug().Int("count", i+1).Str("subDir", this.subDir).Str("srcFilePath", result.Source).
+				Str("dstFilePath", result.Destination).Msg("moved")
+		}
+		results <- result
+	}
+	return movedFileCount
+}
+
+// moveOne moves file from sourcePath into the subdir of this, and reports what it did. Names in the subdir are checked
+// in memory, unless onDisk is set.
+func (options MoveOptions) moveOne(
+	ctx context.Context, sourcePath string, this *batch, file string, onDisk bool,
+) MoveResult {
+	startTime := time.Now()
+	pathExists := this.pathExists
+	if onDisk {
+		pathExists = this.checkOnDisk
+	}
+	srcFilePath := filepath.Join(sourcePath, file)
+	dstFilePath := destinationPath(sourcePath, this.subDir, file, options.PreservePaths)
+	result := func(action Action, reason string, err error) MoveResult {
+		return MoveResult{
+			Source:      srcFilePath,
+			Destination: dstFilePath,
+			SubDir:      this.subDir,
+			Action:      action,
+			Reason:      reason,
+			Err:         err,
+			Duration:    time.Since(startTime),
+			file:        file,
+		}
+	}
+
+	outcome, finalDstFilePath, err := checkMove(ctx, srcFilePath, dstFilePath, options.OnConflict.For(this.subDir), pathExists)
+	if err == nil {
+		dstFilePath = finalDstFilePath
+	}
+	switch outcome {
+	case OutcomeSkipInUse:
+		options.Logger.Debug().Str("file", file).Msg("skipping file: currently in use")
+		return result(ActionDeferred, string(outcome), ErrInUse)
+	case OutcomeMove, OutcomeRename, OutcomeOverwrite:
+		info, err := os.Lstat(srcFilePath)
+		if err != nil {
+			options.Logger.Err(err).Str("file", file).Msg("skipping file: unable to read it")
+			return result(ActionFailed, string(outcome), err)
+		}
+		if err := this.ensureDir(); err != nil {
+			options.Logger.Err(err).Str("file", file).Str("subDir", this.subDir).Msg("skipping file: unable to create dir")
+			return result(ActionFailed, string(outcome), err)
 		}
+		createdDir, err := this.ensureParents(dstFilePath)
+		if err != nil {
+			options.Logger.Err(err).Str("file", file).Str("subDir", this.subDir).Msg("skipping file: unable to create dir")
+			return result(ActionFailed, string(outcome), err)
+		}
+		err = options.moveFile(ctx, srcFilePath, dstFilePath, outcome == OutcomeOverwrite)
+		if errors.Is(err, fs.ErrExist) {
+			this.add(dstFilePath)
+			if !onDisk {
+				// The name was taken after the subdir was listed, or differs only in case on a filesystem that ignores
+				// it: decide again from what's on disk.
+				return options.moveOne(ctx, sourcePath, this, file, true)
+			}
+			// Another process created the destination after checkMove looked: it's an ordinary conflict.
+			options.Logger.Info().Str("fileName", file).Str("dstFilePath", dstFilePath).Msg("skipped")
+			return result(ActionSkipped, string(OutcomeSkipConflict), nil)
+		} else if err != nil {
+			options.Logger.Err(err).Str("file", file).Msg("skipping file: unable to rename")
+			return result(ActionFailed, string(outcome), err)
+		}
+		this.add(dstFilePath)
+		if outcome != OutcomeMove {
+			options.Logger.Info().Str("fileName", file).Str("dstFilePath", dstFilePath).Str("outcome", string(outcome)).
+				Msg("resolved conflict")
+		}
+		if options.Journal != nil {
+			if this.dirCreated {
+				createdDir = this.dstSubDir // undo removes it, and any empty dirs in it, along with the first file moved in
+				this.dirCreated = false
+			}
+			options.recordMove(srcFilePath, dstFilePath, createdDir)
+		}
+		moved := result(ActionMoved, string(outcome), nil)
+		moved.Bytes = info.Size()
+		return moved
+	case OutcomeRemoveDuplicate:
+		if err := os.Remove(srcFilePath); err != nil {
+			options.Logger.Err(err).Str("file", file).Msg("skipping file: unable to remove duplicate")
+			return result(ActionFailed, string(outcome), err)
+		}
+		// Not journalled: there's nothing for undo to move back.
+		options.Logger.Info().Str("fileName", file).Str("dstFilePath", dstFilePath).Msg("removed identical duplicate")
+		return result(ActionRemoved, string(outcome), nil)
+	case OutcomeSkipConflict:
+		options.Logger.Info().Str("fileName", file).Str("dstFilePath", dstFilePath).Msg("skipped")
+		return result(ActionSkipped, string(outcome), nil)
+	default:
+		options.Logger.Err(err).Str("file", file).Msg("skipping file: unable to check destination")
+		return result(ActionFailed, "check destination", err)
+	}
+}
+
+// recordMove adds a completed move to options.Journal, with the dir that had to be created for it, if any. Failures are
+// logged rather than returned: the file has already moved, so the only consequence is that this move can't be undone
+// automatically.
+func (options MoveOptions) recordMove(srcFilePath, dstFilePath, createdDir string) {
+	info, err := os.Lstat(dstFilePath)
+	if err == nil {
+		err = options.Journal.RecordMove(srcFilePath, dstFilePath, info, createdDir)
+	}
+	if err != nil {
+		options.Logger.Err(err).Str("dstFilePath", dstFilePath).Msg("unable to record move in journal")
 	}
-	logger.Info().Int("movedCount", movedFileCount).Int("totalCount", totalFileCount).Msg("moved")
 }
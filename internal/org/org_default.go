@@ -1,9 +1,12 @@
-//go:build !windows
+//go:build !windows && !linux
 
 package org
 
-// isFileInUse returns false on non-Windows systems as file locking is advisory.
+// isFileInUse returns false on systems other than Windows and Linux, as file locking is advisory.
 // We skip this check to avoid skipping files due to permission errors (which os.Rename might handle).
 func isFileInUse(_ string) bool {
 	return false
 }
+
+// resetInUseCache does nothing, as there's no cache here.
+func resetInUseCache() {}
@@ -0,0 +1,116 @@
+//go:build linux
+
+package org
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileID identifies a file independently of the path used to reach it.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// openFiles caches the files other processes have open, found by scanning /proc once per run.
+var openFiles struct {
+	sync.Mutex
+	ids     map[fileID]struct{}
+	scanned bool
+}
+
+// resetInUseCache makes the next isFileInUse scan /proc again. It's called at the start of every run.
+func resetInUseCache() {
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	openFiles.ids = nil
+	openFiles.scanned = false
+}
+
+// isFileInUse checks if another process has the file open, according to /proc, or holds a flock or OFD/POSIX lock on
+// it. Processes the current user can't inspect are invisible, so a false result is a best effort.
+func isFileInUse(filePath string) bool {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false // let the move report the real problem
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	openFiles.Lock()
+	if !openFiles.scanned {
+		openFiles.ids = scanOpenFiles("/proc", os.Getpid())
+		openFiles.scanned = true
+	}
+	_, isOpen := openFiles.ids[fileID{dev: uint64(stat.Dev), ino: stat.Ino}]
+	openFiles.Unlock()
+
+	return isOpen || isFileLocked(filePath)
+}
+
+// scanOpenFiles returns the regular files held open by every process under procDir except ownPID. Processes that exit
+// during the scan, or whose fds we aren't allowed to read, are skipped; if procDir can't be read at all, nothing is
+// found, and only the lock probes are left.
+func scanOpenFiles(procDir string, ownPID int) map[fileID]struct{} {
+	ids := make(map[fileID]struct{})
+	processes, err := os.ReadDir(procDir)
+	if err != nil {
+		return ids
+	}
+
+	for _, process := range processes {
+		pid, err := strconv.Atoi(process.Name())
+		if err != nil || pid == ownPID {
+			continue
+		}
+		fdDir := filepath.Join(procDir, process.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			// Stat follows the fd's magic symlink to the open file itself, even if it has been renamed since.
+			info, err := os.Stat(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				ids[fileID{dev: uint64(stat.Dev), ino: stat.Ino}] = struct{}{}
+			}
+		}
+	}
+	return ids
+}
+
+// isFileLocked probes for a conflicting flock or OFD/POSIX record lock on the file, without keeping any lock itself.
+func isFileLocked(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	fd := int(file.Fd())
+
+	lock := unix.Flock_t{Type: unix.F_WRLCK} // Start and Len of 0 cover the whole file
+	if err := unix.FcntlFlock(uintptr(fd), unix.F_OFD_GETLK, &lock); err == nil && lock.Type != unix.F_UNLCK {
+		return true
+	}
+
+	err = unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return true
+	}
+	if err == nil {
+		unix.Flock(fd, unix.LOCK_UN)
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+//go:build linux
+
+package org
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestIsFileInUse_Linux(t *testing.T) {
+	// Inode numbers are reused, so a stale scan could make files in later tests look open.
+	t.Cleanup(resetInUseCache)
+
+	newFile := func(t *testing.T) string {
+		t.Helper()
+		filePath := filepath.Join(t.TempDir(), "download.iso")
+		if err := os.WriteFile(filePath, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return filePath
+	}
+
+	t.Run("Open in another process", func(t *testing.T) {
+		filePath := newFile(t)
+		file, err := os.Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		// The child inherits the file as its stdin, the way a downloader holds its output open.
+		cmd := exec.Command("sleep", "30")
+		cmd.Stdin = file
+		if err := cmd.Start(); err != nil {
+			t.Skipf("unable to start a child process: %v", err)
+		}
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+
+		resetInUseCache()
+		if !isFileInUse(filePath) {
+			t.Error("expected a file open in another process to be in use")
+		}
+	})
+
+	t.Run("Open only in this process", func(t *testing.T) {
+		filePath := newFile(t)
+		file, err := os.Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		resetInUseCache()
+		if isFileInUse(filePath) {
+			t.Error("expected our own open files to be ignored")
+		}
+	})
+
+	t.Run("flock", func(t *testing.T) {
+		filePath := newFile(t)
+		file, err := os.Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+			t.Fatal(err)
+		}
+
+		resetInUseCache()
+		if !isFileInUse(filePath) {
+			t.Error("expected a flock'ed file to be in use")
+		}
+	})
+
+	t.Run("OFD lock", func(t *testing.T) {
+		filePath := newFile(t)
+		file, err := os.OpenFile(filePath, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		lock := unix.Flock_t{Type: unix.F_WRLCK}
+		if err := unix.FcntlFlock(file.Fd(), unix.F_OFD_SETLK, &lock); err != nil {
+			t.Fatal(err)
+		}
+
+		resetInUseCache()
+		if !isFileInUse(filePath) {
+			t.Error("expected a file with an OFD lock to be in use")
+		}
+	})
+
+	t.Run("Scan is cached per run", func(t *testing.T) {
+		filePath := newFile(t)
+		resetInUseCache()
+		if isFileInUse(filePath) {
+			t.Fatal("expected file to not be in use")
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		cmd := exec.Command("sleep", "30")
+		cmd.Stdin = file
+		if err := cmd.Start(); err != nil {
+			t.Skipf("unable to start a child process: %v", err)
+		}
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+
+		if isFileInUse(filePath) {
+			t.Error("expected the cached scan to be used until the next run")
+		}
+		resetInUseCache()
+		if !isFileInUse(filePath) {
+			t.Error("expected a new run to scan again")
+		}
+	})
+}
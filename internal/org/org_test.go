@@ -1,18 +1,20 @@
 package org
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"testing"
-	"time"
 
 	"github.com/RMBeristain/organise-downloads/internal/common"
-	"github.com/RMBeristain/organise-downloads/internal/logging"
-	"github.com/rs/zerolog"
+	"github.com/RMBeristain/organise-downloads/internal/detect"
+	"github.com/RMBeristain/organise-downloads/internal/journal"
 )
 
-var excludedExtensions = []string{".DS_Store", ".localized"}
+var testRules = Rules{ExcludedExtensions: []string{".DS_Store", ".localized"}}
 
 // getTestsWorkingDir returns the fully-qualified path to a directory where we can temporarily store test artifacts.
 func getTestsWorkingDir() (testsWorkingDir string) {
@@ -103,7 +105,7 @@ func TestGetFilesToMove(t *testing.T) {
 			t.Logf("working on %v", workingDir)
 
 			// make the call we're testing
-			filesToMove := GetFilesToMove(thisCase.input, excludedExtensions)
+			filesToMove, _, _ := GetFilesToMove(context.Background(), workingDir, thisCase.input, testRules)
 
 			// Tests
 			if len(filesToMove) == 0 {
@@ -153,9 +155,6 @@ func TestMoveFile(t *testing.T) {
 		},
 	}
 
-	logging.InitZeroLog()
-	logging.ConfiguredZerologger = logging.ConfiguredZerologger.Level(0) // Set to -1 for TraceLevel
-
 	for _, thisCase := range table {
 		t.Run(
 			thisCase.name,
@@ -163,19 +162,19 @@ func TestMoveFile(t *testing.T) {
 				t.Logf("testing %v", thisCase.input)
 
 				workingDir := getTestsWorkingDir()
-				filesToMove := GetFilesToMove(thisCase.input, excludedExtensions)
+				filesToMove, _, _ := GetFilesToMove(context.Background(), workingDir, thisCase.input, testRules)
 				expectedNewDir := filepath.Join(workingDir, thisCase.expectedPath)
-				filesChannel := make(chan string)
+				results := make(chan MoveResult)
 
 				// make the call we're testing
-				go MoveFiles(workingDir, filesToMove, filesChannel)
-				movedFile := <-filesChannel
+				go MoveFiles(context.Background(), workingDir, filesToMove, results, MoveOptions{})
+				result := <-results
 
 				// Tests
-				if len(thisCase.input) > 0 && movedFile == "" {
-					t.Fatalf("expected a message, got empty string")
-				} else if len(thisCase.input) == 0 && movedFile != "" {
-					t.Fatalf("expected 'movedFile' to be empty string, got %v", movedFile)
+				if len(thisCase.input) > 0 && result.Action != ActionMoved {
+					t.Fatalf("expected the file to be moved, got %+v", result)
+				} else if len(thisCase.input) == 0 && result != (MoveResult{}) {
+					t.Fatalf("expected no result, got %+v", result)
 				}
 
 				files, err := os.ReadDir(expectedNewDir)
@@ -216,10 +215,12 @@ func (m mockDirEntry) Info() (fs.FileInfo, error) { return nil, nil }
 
 func TestGetFilesToMove_EdgeCases(t *testing.T) {
 	tests := []struct {
-		name     string
-		input    []fs.DirEntry
-		excluded []string
-		validate func(t *testing.T, targets map[string][]string)
+		name       string
+		input      []fs.DirEntry
+		excluded   []string
+		categories common.CategoryIndex
+		duplicates map[string]string
+		validate   func(t *testing.T, targets map[string][]string)
 	}{
 		{
 			name: "Directory entry",
@@ -228,11 +229,8 @@ func TestGetFilesToMove_EdgeCases(t *testing.T) {
 			},
 			excluded: []string{},
 			validate: func(t *testing.T, targets map[string][]string) {
-				if _, ok := targets["subdir"]; !ok {
-					t.Error("Expected directory 'subdir' to be in targets")
-				}
-				if len(targets["subdir"]) != 0 {
-					t.Errorf("Expected empty slice for directory, got %v", targets["subdir"])
+				if len(targets) != 0 {
+					t.Errorf("Expected directory to be left out of targets, got %v", targets)
 				}
 			},
 		},
@@ -248,20 +246,91 @@ func TestGetFilesToMove_EdgeCases(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "Duplicate file",
+			input: []fs.DirEntry{
+				mockDirEntry{name: "file.pdf", isDir: false},
+				mockDirEntry{name: "file (1).pdf", isDir: false},
+			},
+			excluded:   []string{},
+			duplicates: map[string]string{"file (1).pdf": "file.pdf"},
+			validate: func(t *testing.T, targets map[string][]string) {
+				if len(targets["pdf_files"]) != 1 || targets["pdf_files"][0] != "file.pdf" {
+					t.Errorf("Expected only the kept copy to be moved, got %v", targets)
+				}
+			},
+		},
+		{
+			name: "Files grouped by category",
+			input: []fs.DirEntry{
+				mockDirEntry{name: "photo.JPG", isDir: false},
+				mockDirEntry{name: "scan.png", isDir: false},
+				mockDirEntry{name: "notes.txt", isDir: false},
+			},
+			excluded:   []string{},
+			categories: common.CategoryIndex{".jpg": "Images", ".png": "Images"},
+			validate: func(t *testing.T, targets map[string][]string) {
+				if len(targets["Images"]) != 2 {
+					t.Errorf("Expected 2 files in 'Images', got %v", targets["Images"])
+				}
+				if len(targets["txt_files"]) != 1 {
+					t.Errorf("Expected uncategorised file in 'txt_files', got %v", targets)
+				}
+			},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			targets := GetFilesToMove(tt.input, tt.excluded)
+			targets, _, _ := GetFilesToMove(context.Background(), "", tt.input, Rules{
+				ExcludedExtensions: tt.excluded,
+				Categories:         tt.categories,
+				Duplicates:         tt.duplicates,
+			})
 			tt.validate(t, targets)
 		})
 	}
 }
 
-func TestMoveFiles_EdgeCases(t *testing.T) {
-	logging.InitZeroLog()
-	logging.ConfiguredZerologger = logging.ConfiguredZerologger.Level(zerolog.Disabled)
+func TestGetFilesToMove_ContentDetection(t *testing.T) {
+	tmpDir := t.TempDir()
+	pdf := []byte("%PDF-1.7\n")
+	for _, name := range []string{"download", "file.php?id=3", "report.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), pdf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		mode     detect.Mode
+		expected map[string]int // number of files expected in each subdir
+	}{
+		{"Off", detect.ModeOff, map[string]int{"_files": 1, "php?id=3_files": 1, "txt_files": 1}},
+		{"Extension wins", detect.ModeExtensionWins, map[string]int{"Documents": 2, "txt_files": 1}},
+		{"Content wins", detect.ModeContentWins, map[string]int{"Documents": 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := Rules{Categories: common.CategoryIndex{".pdf": "Documents"}, ContentDetection: tt.mode}
+			targets, _, _ := GetFilesToMove(context.Background(), tmpDir, files, rules)
+			if len(targets) != len(tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, targets)
+			}
+			for subDir, count := range tt.expected {
+				if len(targets[subDir]) != count {
+					t.Errorf("expected %d file(s) in %q, got %v", count, subDir, targets[subDir])
+				}
+			}
+		})
+	}
+}
 
+func TestMoveFiles_EdgeCases(t *testing.T) {
 	t.Run("Destination file already exists", func(t *testing.T) {
 		tmpDir, err := os.MkdirTemp("", "org_test_conflict")
 		if err != nil {
@@ -289,16 +358,14 @@ func TestMoveFiles_EdgeCases(t *testing.T) {
 		filesToMove := map[string][]string{
 			subDir: {fileName},
 		}
-		filesChannel := make(chan string, 1)
+		results := make(chan MoveResult, 1)
 
-		MoveFiles(tmpDir, filesToMove, filesChannel)
+		MoveFiles(context.Background(), tmpDir, filesToMove, results, MoveOptions{})
 
-		// Expectation: Channel receives the path, but file is not moved.
-		select {
-		case <-filesChannel:
-			// OK
-		case <-time.After(100 * time.Millisecond):
-			t.Error("Expected file path in channel even if skipped")
+		// Expectation: the file is reported as skipped, and not moved.
+		result := <-results
+		if result.Action != ActionSkipped || result.Reason != string(OutcomeSkipConflict) {
+			t.Errorf("expected a skipped conflict, got %+v", result)
 		}
 
 		// Verify source file still exists
@@ -317,22 +384,125 @@ func TestMoveFiles_EdgeCases(t *testing.T) {
 		filesToMove := map[string][]string{
 			"any_dir": {"missing.txt"},
 		}
-		filesChannel := make(chan string, 1)
+		results := make(chan MoveResult, 1)
 
-		MoveFiles(tmpDir, filesToMove, filesChannel)
+		MoveFiles(context.Background(), tmpDir, filesToMove, results, MoveOptions{})
 
-		// Expectation: Channel receives nothing (rename fails -> continue).
-		select {
-		case msg := <-filesChannel:
-			if msg != "" {
-				t.Errorf("Expected no message in channel for missing file, got %s", msg)
-			}
-		case <-time.After(100 * time.Millisecond):
-			// OK
+		// Expectation: the file is reported as failed.
+		result := <-results
+		if result.Action != ActionFailed || !errors.Is(result.Err, fs.ErrNotExist) {
+			t.Errorf("expected the missing file to fail, got %+v", result)
 		}
 	})
 }
 
+func TestMoveFiles_Journal(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journalPath := filepath.Join(t.TempDir(), journal.FileName)
+	moveJournal, err := journal.Open(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan MoveResult, 2)
+	MoveFiles(context.Background(), tmpDir, map[string][]string{"txt_files": {"a.txt", "b.txt"}}, results, MoveOptions{Journal: moveJournal})
+	moveJournal.Close()
+
+	entries, err := journal.ReadEntries(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 journal entries, got %v", entries)
+	}
+	createdDirCount := 0
+	for _, entry := range entries {
+		if entry.RunID != moveJournal.RunID() || entry.Op != journal.OpMove {
+			t.Errorf("unexpected entry %+v", entry)
+		}
+		if entry.CreatedDir != "" {
+			createdDirCount++
+		}
+	}
+	if createdDirCount != 1 {
+		t.Errorf("expected exactly one entry to record the created dir, got %d", createdDirCount)
+	}
+}
+
+func TestMoveFiles_Workers(t *testing.T) {
+	tmpDir := t.TempDir()
+	filesToMove := make(map[string][]string)
+	for _, subDir := range []string{"a_files", "b_files", "c_files", "d_files"} {
+		for i := range 5 {
+			name := fmt.Sprintf("%s-%d.%s", subDir, i, subDir[:1])
+			if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+			filesToMove[subDir] = append(filesToMove[subDir], name)
+		}
+	}
+	// A file where a subdir should be: creating the dir fails, and must fail the same way for every file bound for it.
+	if err := os.WriteFile(filepath.Join(tmpDir, "d_files"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	journalPath := filepath.Join(t.TempDir(), journal.FileName)
+	moveJournal, err := journal.Open(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan MoveResult, 20)
+	MoveFiles(context.Background(), tmpDir, filesToMove, results, MoveOptions{Journal: moveJournal, Workers: 3})
+	moveJournal.Close()
+
+	bySubDir := make(map[string][]MoveResult)
+	for result := range results {
+		bySubDir[result.SubDir] = append(bySubDir[result.SubDir], result)
+	}
+	for subDir, files := range filesToMove {
+		subDirResults := bySubDir[subDir]
+		if len(subDirResults) != len(files) {
+			t.Fatalf("expected %d results for %s, got %+v", len(files), subDir, subDirResults)
+		}
+		for i, result := range subDirResults {
+			if result.File() != files[i] {
+				t.Errorf("expected results for %s in plan order, got %s at %d", subDir, result.File(), i)
+			}
+			wantAction := ActionMoved
+			if subDir == "d_files" {
+				wantAction = ActionFailed
+			}
+			if result.Action != wantAction {
+				t.Errorf("expected %s to be %s, got %+v", result.File(), wantAction, result)
+			}
+		}
+	}
+
+	entries, err := journal.ReadEntries(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdDirs := make(map[string]int)
+	for _, entry := range entries {
+		if entry.CreatedDir != "" {
+			createdDirs[filepath.Base(entry.CreatedDir)]++
+		}
+	}
+	if len(entries) != 15 || len(createdDirs) != 3 {
+		t.Errorf("expected 15 moves and 3 created dirs to be recorded, got %d and %v", len(entries), createdDirs)
+	}
+	for subDir, count := range createdDirs {
+		if count != 1 {
+			t.Errorf("expected %s to be recorded as created once, got %d", subDir, count)
+		}
+	}
+}
+
 func TestIsFileInUse(t *testing.T) {
 	tmp := t.TempDir()
 	file := filepath.Join(tmp, "test.txt")
@@ -13,3 +13,6 @@ func isFileInUse(filePath string) bool {
 	file.Close()
 	return false
 }
+
+// resetInUseCache does nothing, as each file is checked directly.
+func resetInUseCache() {}
@@ -0,0 +1,219 @@
+package org
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/RMBeristain/organise-downloads/internal/dedupe"
+)
+
+// organiserDirs are the dirs in the source dir, besides the subdirs files are moved into, that hold the organiser's own
+// files. log_files is where logs were kept before they moved to the state dir.
+var organiserDirs = []string{"log_files", dedupe.TrashDirName}
+
+// isOrganiserDir returns whether name, a dir directly inside sourcePath, is one the organiser moves files into or
+// keeps its own files in, and so must not be walked by a recursive run.
+func (rules Rules) isOrganiserDir(sourcePath, name string) bool {
+	return contains(organiserDirs, name) || rules.isSubdir(sourcePath, name)
+}
+
+// isSubdir returns whether name, a dir directly inside sourcePath, is one files are sorted into: a category folder, or
+// an '<ext>_files' folder that holds a file with that extension. A folder that only happens to end in '_files', like
+// 'project_files', holds none, so it's treated like any other dir.
+func (rules Rules) isSubdir(sourcePath, name string) bool {
+	for _, category := range rules.Categories {
+		if category == name {
+			return true
+		}
+	}
+	if !strings.HasSuffix(name, "_files") {
+		return false
+	}
+	dir, err := os.Open(filepath.Join(sourcePath, name))
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+	for {
+		fileNames, err := dir.Readdirnames(64)
+		for _, fileName := range fileNames {
+			if strings.EqualFold(rules.Categories.Subdir(filepath.Ext(fileName)), name) {
+				return true
+			}
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+// nestedEntry is a file below the source dir, named by its path relative to the source dir rather than by its base
+// name, so it can be classified and moved like any other entry.
+type nestedEntry struct {
+	fs.DirEntry
+	path string
+}
+
+// Name returns the path of the entry relative to the source dir.
+func (entry nestedEntry) Name() string {
+	return entry.path
+}
+
+// entryFor returns the DirEntry of info, named fileName, which may be a path relative to the source dir.
+func entryFor(fileName string, info fs.FileInfo) fs.DirEntry {
+	entry := fs.FileInfoToDirEntry(info)
+	if fileName == info.Name() {
+		return entry
+	}
+	return nestedEntry{DirEntry: entry, path: fileName}
+}
+
+// namedInfo is the FileInfo of a nestedEntry, named the same way.
+type namedInfo struct {
+	fs.FileInfo
+	path string
+}
+
+// Name returns the path of the file relative to the source dir.
+func (info namedInfo) Name() string {
+	return info.path
+}
+
+// dirWalker finds the files below a source dir for a recursive run. It remembers every dir it walked, so a symlinked
+// dir can't lead it round in circles, or through the same files twice.
+type dirWalker struct {
+	sourcePath     string
+	realSourcePath string // sourcePath with symlinks resolved, to tell where a symlinked dir leads
+	visited        visitedDirs
+}
+
+// sameFileSet is a set of files told apart with os.SameFile, which takes a scan of the whole set to look one up. It's
+// what visitedDirs falls back to where files have no device and inode numbers.
+type sameFileSet []os.FileInfo
+
+// add adds the file info describes, and returns false if it was already in the set.
+func (set *sameFileSet) add(info os.FileInfo) bool {
+	for _, seen := range *set {
+		if os.SameFile(seen, info) {
+			return false
+		}
+	}
+	*set = append(*set, info)
+	return true
+}
+
+// newDirWalker returns a dirWalker for sourcePath, which counts as already walked.
+func newDirWalker(sourcePath string) *dirWalker {
+	walker := &dirWalker{sourcePath: sourcePath}
+	if info, err := os.Stat(sourcePath); err == nil {
+		walker.visited.add(info)
+	}
+	walker.realSourcePath, _ = filepath.EvalSymlinks(sourcePath) // if it fails, no symlinked dir is followed
+	return walker
+}
+
+// withNestedFiles returns files, which are entries of the source dir, with the files in their subdirs added, down to
+// rules.MaxDepth levels. The organiser's own dirs aren't walked. A symlinked dir is walked in place of the link if it
+// leads somewhere else in the source dir, other than the organiser's own dirs. Otherwise a link in the source dir is
+// treated like a file, as it is when the run isn't recursive, and one further down is left alone. Subdirs that can't
+// be read are logged and left out. The only error is ctx's.
+func (rules Rules) withNestedFiles(ctx context.Context, walker *dirWalker, files []fs.DirEntry) ([]fs.DirEntry, error) {
+	if rules.MaxDepth <= 0 {
+		return files, nil
+	}
+
+	expanded := make([]fs.DirEntry, 0, len(files))
+	for _, file := range files {
+		isLink := file.Type()&fs.ModeSymlink != 0
+		if file.IsDir() {
+			expanded = append(expanded, file) // still an entry, as in a run that isn't recursive
+			if rules.isOrganiserDir(walker.sourcePath, file.Name()) {
+				continue
+			}
+		} else if !isLink {
+			expanded = append(expanded, file)
+			continue
+		}
+
+		nested, walked, err := walker.walk(ctx, rules, file.Name(), isLink, 1)
+		if err != nil {
+			return nil, err
+		}
+		if isLink && !walked {
+			expanded = append(expanded, file)
+		}
+		expanded = append(expanded, nested...)
+	}
+	return expanded, nil
+}
+
+// walk returns the files in relDir, a dir at depth levels below the source dir, and in its subdirs, down to
+// rules.MaxDepth. walked is false if relDir wasn't walked because it's a link that doesn't lead to a dir that may be.
+// A dir that was already walked returns no files. Links to files are returned like files. The only error is ctx's.
+func (walker *dirWalker) walk(
+	ctx context.Context, rules Rules, relDir string, isLink bool, depth int,
+) (nested []fs.DirEntry, walked bool, err error) {
+	path := filepath.Join(walker.sourcePath, relDir)
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return nil, false, nil
+	}
+	if isLink && !walker.mayFollow(rules, path) {
+		rules.Logger.Debug().Str("dir", relDir).Msg("not following link out of the downloads dir")
+		return nil, false, nil
+	}
+	if !walker.visited.add(info) {
+		rules.Logger.Debug().Str("dir", relDir).Msg("already walked; not walking it again")
+		return nil, true, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		rules.Logger.Warn().Err(err).Str("dir", relDir).Msg("unable to read subdir; leaving it alone")
+		return nil, true, nil
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, true, err
+		}
+		relPath := filepath.Join(relDir, entry.Name())
+		isLink := entry.Type()&fs.ModeSymlink != 0
+		if entry.IsDir() || (isLink && walker.isDir(relPath)) {
+			if depth >= rules.MaxDepth {
+				rules.Logger.Debug().Str("dir", relPath).Int("maxDepth", rules.MaxDepth).Msg("too deep; not walking it")
+				continue
+			}
+			files, _, err := walker.walk(ctx, rules, relPath, isLink, depth+1)
+			if err != nil {
+				return nil, true, err
+			}
+			nested = append(nested, files...)
+			continue
+		}
+		nested = append(nested, nestedEntry{DirEntry: entry, path: relPath})
+	}
+	return nested, true, nil
+}
+
+// isDir returns whether relPath leads to a dir, following links.
+func (walker *dirWalker) isDir(relPath string) bool {
+	info, err := os.Stat(filepath.Join(walker.sourcePath, relPath))
+	return err == nil && info.IsDir()
+}
+
+// mayFollow returns whether the symlinked dir at path leads somewhere in the source dir that may be walked.
+func (walker *dirWalker) mayFollow(rules Rules, path string) bool {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil || walker.realSourcePath == "" {
+		return false
+	}
+	relTarget, err := filepath.Rel(walker.realSourcePath, target)
+	if err != nil || !filepath.IsLocal(relTarget) {
+		return false
+	}
+	topDir, _, _ := strings.Cut(filepath.ToSlash(relTarget), "/")
+	return !rules.isOrganiserDir(walker.realSourcePath, topDir)
+}
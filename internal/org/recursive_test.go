@@ -0,0 +1,244 @@
+package org
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/RMBeristain/organise-downloads/internal/common"
+	"github.com/RMBeristain/organise-downloads/internal/dedupe"
+	"github.com/RMBeristain/organise-downloads/internal/journal"
+)
+
+// setupNestedDir writes files, named by their paths relative to a temp dir, creating the dirs they're in, and returns
+// the temp dir.
+func setupNestedDir(t *testing.T, files ...string) string {
+	t.Helper()
+	sourceDir := t.TempDir()
+	for _, name := range files {
+		path := filepath.Join(sourceDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sourceDir
+}
+
+// symlinkOrSkip creates a symlink, or skips the test where the OS doesn't let us.
+func symlinkOrSkip(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("unable to create symlink: %v", err)
+	}
+}
+
+func TestGetFilesToMove_Recursive(t *testing.T) {
+	sourceDir := setupNestedDir(t,
+		"top.pdf",
+		"unpacked/a.pdf",
+		"unpacked/deep/b.txt",
+		"unpacked/deep/deeper/c.txt",
+		"txt_files/old.txt",
+		"project_files/notes.txt",
+		"Images/old.jpg",
+		"log_files/organise-downloads.log",
+		"duplicates_trash/copy.pdf",
+	)
+	outsideDir := setupNestedDir(t, "private.txt")
+	symlinkOrSkip(t, "..", filepath.Join(sourceDir, "unpacked", "loop"))
+	symlinkOrSkip(t, filepath.Join(sourceDir, "unpacked", "deep"), filepath.Join(sourceDir, "z-shortcut"))
+	symlinkOrSkip(t, outsideDir, filepath.Join(sourceDir, "unpacked", "outside"))
+	symlinkOrSkip(t, filepath.Join(sourceDir, "txt_files"), filepath.Join(sourceDir, "unpacked", "sorted"))
+	files, err := os.ReadDir(sourceDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	categories, err := common.NewCategoryIndex(map[string][]string{"Images": {".jpg"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		maxDepth int
+		expect   []string
+	}{
+		{"Not recursive", 0, []string{"top.pdf", "z-shortcut"}},
+		// unpacked/deep is too deep, but the same dir is only one level down through the link.
+		// project_files only looks like an organiser dir: there's no '.project' file in it.
+		{"One level", 1, []string{"project_files/notes.txt", "top.pdf", "unpacked/a.pdf", "z-shortcut/b.txt"}},
+		// The link leads to a dir that was already walked.
+		{"Deep enough for everything", 5, []string{
+			"project_files/notes.txt", "top.pdf", "unpacked/a.pdf", "unpacked/deep/b.txt", "unpacked/deep/deeper/c.txt",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := Rules{Categories: categories, MaxDepth: tt.maxDepth}
+			targets, _, err := GetFilesToMove(context.Background(), sourceDir, files, rules)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var moved []string
+			for _, subDirFiles := range targets {
+				for _, file := range subDirFiles {
+					moved = append(moved, filepath.ToSlash(file))
+				}
+			}
+			sort.Strings(moved)
+			if len(moved) != len(tt.expect) {
+				t.Fatalf("expected %v, got %v", tt.expect, moved)
+			}
+			for i := range moved {
+				if moved[i] != tt.expect[i] {
+					t.Errorf("expected %v, got %v", tt.expect, moved)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestMoveFiles_Recursive(t *testing.T) {
+	for _, preservePaths := range []bool{false, true} {
+		sourceDir := setupNestedDir(t, "unpacked/deep/b.txt", "unpacked/a.txt")
+		journalPath := filepath.Join(t.TempDir(), journal.FileName)
+		moveJournal, err := journal.Open(journalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filesToMove := map[string][]string{"txt_files": {
+			filepath.Join("unpacked", "deep", "b.txt"), filepath.Join("unpacked", "a.txt"),
+		}}
+		results := make(chan MoveResult, 2)
+		MoveFiles(context.Background(), sourceDir, filesToMove, results,
+			MoveOptions{Journal: moveJournal, PreservePaths: preservePaths})
+		t.Cleanup(func() { moveJournal.Close() })
+
+		expectDsts := []string{"txt_files/b.txt", "txt_files/a.txt"}
+		if preservePaths {
+			expectDsts = []string{"txt_files/unpacked/deep/b.txt", "txt_files/unpacked/a.txt"}
+		}
+		i := 0
+		for result := range results {
+			if result.File() != filesToMove["txt_files"][i] {
+				t.Errorf("expected the result to be named %s, got %s", filesToMove["txt_files"][i], result.File())
+			}
+			if result.Action != ActionMoved || result.Destination != filepath.Join(sourceDir, filepath.FromSlash(expectDsts[i])) {
+				t.Errorf("expected %s to be moved to %s (preservePaths=%v), got %+v", result.File(), expectDsts[i],
+					preservePaths, result)
+			}
+			i++
+		}
+
+		// Undo puts the files back where they were nested, and removes every dir the moves created.
+		entries, err := journal.ReadEntries(journalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := journal.Undo(moveJournal, entries, moveJournal.RunID(), moveBack); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(sourceDir, "unpacked", "deep", "b.txt")); err != nil {
+			t.Errorf("expected b.txt to be back (preservePaths=%v), got %v", preservePaths, err)
+		}
+		if _, err := os.Stat(filepath.Join(sourceDir, "txt_files")); !os.IsNotExist(err) {
+			t.Errorf("expected txt_files to be removed (preservePaths=%v), got %v", preservePaths, err)
+		}
+	}
+}
+
+func TestEntriesFor_Nested(t *testing.T) {
+	sourceDir := setupNestedDir(t, "unpacked/a.pdf", "unpacked/a.pdf.part")
+	fileName := filepath.Join("unpacked", "a.pdf")
+
+	entries, err := EntriesFor(sourceDir, fileName, Rules{PartialSuffixes: []string{".part"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Name() != fileName || entries[1].Name() != fileName+".part" {
+		t.Errorf("expected entries named by their paths relative to the source dir, got %v", entries)
+	}
+}
+
+func TestFindDuplicates_Recursive(t *testing.T) {
+	sourceDir := setupNestedDir(t)
+	contents := map[string]string{
+		"report.pdf":                   "report",
+		"unpacked/report.pdf":          "report",
+		"unpacked/deep/report (1).pdf": "report",
+		"unpacked/old.pdf":             "old",
+		"pdf_files/old.pdf":            "old",
+	}
+	for name, content := range contents {
+		path := filepath.Join(sourceDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := os.ReadDir(sourceDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := Rules{MaxDepth: 2}
+
+	groups, err := FindDuplicates(context.Background(), sourceDir, files, rules, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rules.Duplicates = dedupe.DuplicatesIn(groups, sourceDir)
+	expected := map[string]string{
+		filepath.Join("unpacked", "report.pdf"):             filepath.Join(sourceDir, "report.pdf"),
+		filepath.Join("unpacked", "deep", "report (1).pdf"): filepath.Join(sourceDir, "report.pdf"),
+		filepath.Join("unpacked", "old.pdf"):                filepath.Join(sourceDir, "pdf_files", "old.pdf"),
+	}
+	if len(rules.Duplicates) != len(expected) {
+		t.Errorf("expected duplicates %v, got %v", expected, rules.Duplicates)
+	}
+	for name, keep := range expected {
+		if rules.Duplicates[name] != keep {
+			t.Errorf("expected %s to be a duplicate of %s, got %v", name, keep, rules.Duplicates)
+		}
+	}
+
+	targets, _, err := GetFilesToMove(context.Background(), sourceDir, files, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moving := targets["pdf_files"]; len(moving) != 1 || moving[0] != "report.pdf" {
+		t.Errorf("expected only the kept copy to be moved, got %v", targets)
+	}
+}
+
+func TestVisitedDirs(t *testing.T) {
+	sourceDir := setupNestedDir(t, "a/file.txt", "b/file.txt")
+	symlinkOrSkip(t, filepath.Join(sourceDir, "a"), filepath.Join(sourceDir, "link"))
+	stat := func(name string) os.FileInfo {
+		t.Helper()
+		info, err := os.Stat(filepath.Join(sourceDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	var visited visitedDirs
+	for _, tt := range []struct {
+		name  string
+		isNew bool
+	}{{"a", true}, {"b", true}, {"link", false}, {"a", false}} {
+		if isNew := visited.add(stat(tt.name)); isNew != tt.isNew {
+			t.Errorf("expected adding %s to return %v, got %v", tt.name, tt.isNew, isNew)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package org
+
+// renameNoReplace renames oldpath to newpath, unless newpath exists, in which case the error matches fs.ErrExist. There's
+// no portable atomic way to do this, so the check and the rename are separate steps here.
+func renameNoReplace(oldpath, newpath string) error {
+	return renameNoReplaceFallback(oldpath, newpath)
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package org
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// renameNoReplace renames oldpath to newpath with renameat2(RENAME_NOREPLACE), so checking that newpath is free and
+// renaming happen in one atomic step. If newpath exists the error matches fs.ErrExist. Kernels and filesystems that
+// don't support the flag get the portable fallback.
+func renameNoReplace(oldpath, newpath string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, oldpath, unix.AT_FDCWD, newpath, unix.RENAME_NOREPLACE)
+	if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL) {
+		return renameNoReplaceFallback(oldpath, newpath)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "renameat2", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
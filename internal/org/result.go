@@ -0,0 +1,54 @@
+package org
+
+import (
+	"time"
+)
+
+// Action is what became of a file MoveFiles was given.
+type Action string
+
+const (
+	ActionMoved    Action = "moved"    // the file is in its subdir
+	ActionRemoved  Action = "removed"  // the file was deleted, as an identical copy of it was already in its subdir
+	ActionSkipped  Action = "skipped"  // the file was left where it is on purpose, such as a conflict the policy skips
+	ActionDeferred Action = "deferred" // the file was left where it is for now, because another process is using it
+	ActionFailed   Action = "failed"   // the file couldn't be moved; Err says why
+)
+
+// MoveResult reports what MoveFiles did with one file.
+type MoveResult struct {
+	Source      string
+	Destination string // where the file is now, or would have gone if it wasn't moved
+	SubDir      string // the subdir the file was bound for
+	Action      Action
+	Reason      string        // the Outcome that was carried out or, for failures, what was being done
+	Err         error         // why the file was deferred or failed; nil otherwise
+	Bytes       int64         // the size of a moved file
+	Duration    time.Duration // how long the file took to handle
+	file        string        // the name of the file in the plan, relative to the source dir
+}
+
+// File returns the name of the file the result is about, relative to the source dir, as it's named in the plan.
+func (result MoveResult) File() string {
+	return result.file
+}
+
+// Retryable returns whether a later attempt might move the file.
+func (result MoveResult) Retryable() bool {
+	return result.Action == ActionDeferred || result.Action == ActionFailed
+}
+
+// MoveStats counts how MoveStream checked whether names in the destination subdirs were taken. Each memory lookup is a
+// stat that didn't have to be made, at the cost of listing each subdir once.
+type MoveStats struct {
+	DirsListed    int64 // destination subdirs read into memory
+	MemoryLookups int64 // names checked in memory
+	DiskLookups   int64 // names checked with a stat, because a subdir couldn't be listed or was out of date
+}
+
+// add adds the counts of other to stats.
+func (stats *MoveStats) add(other MoveStats) {
+	stats.DirsListed += other.DirsListed
+	stats.MemoryLookups += other.MemoryLookups
+	stats.DiskLookups += other.DiskLookups
+}
@@ -0,0 +1,166 @@
+package org
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Deferred is a file that isn't moved yet because it may still be being written, and why.
+type Deferred struct {
+	File      string    `json:"file"`
+	Reason    string    `json:"reason"`
+	SettlesAt time.Time `json:"-"` // when the file will be old enough to move, if it isn't changed again; zero if unknown
+}
+
+// sleep waits for d, or until ctx is done, in which case it returns ctx's error. Tests replace it to change files
+// between samples.
+var sleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// downloadInProgress returns whether fileName belongs to a download that hasn't finished, and why. That's the case if
+// fileName is itself a partial download, or if siblingExists reports a sibling with a partial suffix: Firefox, for
+// example, creates 'movie.mkv' as an empty placeholder next to 'movie.mkv.part', and fails if it's moved away.
+func (rules Rules) downloadInProgress(fileName string, siblingExists func(name string) bool) (string, bool) {
+	for _, suffix := range rules.PartialSuffixes {
+		if suffix == "" {
+			continue
+		}
+		if siblingExists(fileName + suffix) {
+			return "download in progress: " + fileName + suffix, true
+		}
+	}
+	if rules.isPartial(fileName) {
+		return "download in progress", true
+	}
+	return "", false
+}
+
+// isPartial returns whether fileName has one of the suffixes of an in-progress download.
+func (rules Rules) isPartial(fileName string) bool {
+	for _, suffix := range rules.PartialSuffixes {
+		if suffix != "" && len(fileName) > len(suffix) && strings.HasSuffix(fileName, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// EntriesFor returns the DirEntry of fileName in sourcePath, followed by those of any in-progress download siblings, so
+// GetFilesToMove treats a single file the same way as it would in a scan of the whole dir.
+func EntriesFor(sourcePath, fileName string, rules Rules) ([]fs.DirEntry, error) {
+	info, err := os.Lstat(filepath.Join(sourcePath, fileName))
+	if err != nil {
+		return nil, err
+	}
+	entries := []fs.DirEntry{entryFor(fileName, info)}
+	for _, suffix := range rules.PartialSuffixes {
+		if suffix == "" {
+			continue
+		}
+		if info, err := os.Lstat(filepath.Join(sourcePath, fileName+suffix)); err == nil {
+			entries = append(entries, entryFor(fileName+suffix, info))
+		}
+	}
+	return entries, nil
+}
+
+// settledFiles splits files into the names of those that are safe to move and those that must wait for a later run.
+//
+// A file is settled if it was last modified at least rules.MinAge ago. Younger files get a second chance if
+// rules.StabilityInterval is set: they're sampled again after that interval, all together, and the ones whose size and
+// mtime didn't change are settled too. A zero MinAge settles every file without looking at it. The only error is ctx's,
+// if it's done while waiting to sample again.
+func (rules Rules) settledFiles(
+	ctx context.Context, sourcePath string, files []fs.DirEntry,
+) (settled []string, deferred []Deferred, err error) {
+	settled, young, deferred := rules.splitByAge(files)
+	resettled, unsettled, err := rules.resample(ctx, sourcePath, young)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(settled, resettled...), append(deferred, unsettled...), nil
+}
+
+// splitByAge returns the names of the files that are old enough to be settled, and the others, which resample decides
+// about. Files that can't be looked at are deferred.
+func (rules Rules) splitByAge(files []fs.DirEntry) (settled []string, young []fs.FileInfo, deferred []Deferred) {
+	if rules.MinAge <= 0 {
+		for _, file := range files {
+			settled = append(settled, file.Name())
+		}
+		return settled, nil, nil
+	}
+
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			deferred = append(deferred, Deferred{File: file.Name(), Reason: err.Error()})
+			continue
+		}
+		if file.Name() != info.Name() {
+			info = namedInfo{FileInfo: info, path: file.Name()} // a nested file, which resample must find again
+		}
+		if age := time.Since(info.ModTime()); age < rules.MinAge {
+			young = append(young, info)
+			continue
+		}
+		settled = append(settled, file.Name())
+	}
+	return settled, young, deferred
+}
+
+// resample samples young again after rules.StabilityInterval, and returns the names of those that didn't change. If
+// there's no interval, every file in young is deferred.
+func (rules Rules) resample(
+	ctx context.Context, sourcePath string, young []fs.FileInfo,
+) (settled []string, deferred []Deferred, err error) {
+	if len(young) == 0 {
+		return nil, nil, nil
+	}
+
+	if rules.StabilityInterval <= 0 {
+		for _, info := range young {
+			deferred = append(deferred, rules.deferYoung(info))
+		}
+		return nil, deferred, nil
+	}
+
+	if err := sleep(ctx, rules.StabilityInterval); err != nil {
+		return nil, nil, err
+	}
+	for _, first := range young {
+		second, err := os.Lstat(filepath.Join(sourcePath, first.Name()))
+		switch {
+		case err != nil:
+			deferred = append(deferred, Deferred{File: first.Name(), Reason: err.Error()})
+		case second.Size() != first.Size() || !second.ModTime().Equal(first.ModTime()):
+			deferred = append(deferred, Deferred{
+				File: first.Name(), Reason: "still being written", SettlesAt: second.ModTime().Add(rules.MinAge),
+			})
+		default:
+			settled = append(settled, first.Name())
+		}
+	}
+	return settled, deferred, nil
+}
+
+// deferYoung defers a file that's younger than rules.MinAge until it's old enough.
+func (rules Rules) deferYoung(info fs.FileInfo) Deferred {
+	age := time.Since(info.ModTime()).Round(time.Second)
+	return Deferred{
+		File: info.Name(), Reason: fmt.Sprintf("modified %s ago", age), SettlesAt: info.ModTime().Add(rules.MinAge),
+	}
+}
@@ -0,0 +1,178 @@
+package org
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RMBeristain/organise-downloads/internal/common"
+)
+
+func TestGetFilesToMove_Stability(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"old.iso", "stable.iso", "growing.iso"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	older := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(tmpDir, "old.iso"), older, older); err != nil {
+		t.Fatal(err)
+	}
+	files, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A downloader keeps writing to growing.iso while we wait between samples.
+	sleepCount := 0
+	originalSleep := sleep
+	sleep = func(context.Context, time.Duration) error {
+		sleepCount++
+		growing, err := os.OpenFile(filepath.Join(tmpDir, "growing.iso"), os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer growing.Close()
+		if _, err := growing.WriteString("more"); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}
+	t.Cleanup(func() { sleep = originalSleep })
+
+	tests := []struct {
+		name             string
+		rules            Rules
+		expectMoved      []string
+		expectDeferred   []string
+		expectSleepCount int
+	}{
+		{
+			name:        "Off",
+			rules:       Rules{},
+			expectMoved: []string{"growing.iso", "old.iso", "stable.iso"},
+		},
+		{
+			name:           "Age only",
+			rules:          Rules{MinAge: time.Minute},
+			expectMoved:    []string{"old.iso"},
+			expectDeferred: []string{"growing.iso", "stable.iso"},
+		},
+		{
+			name:             "Age or stable size",
+			rules:            Rules{MinAge: time.Minute, StabilityInterval: time.Second},
+			expectMoved:      []string{"old.iso", "stable.iso"},
+			expectDeferred:   []string{"growing.iso"},
+			expectSleepCount: 1, // young files are sampled together, not one interval per file
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sleepCount = 0
+			targets, deferred, _ := GetFilesToMove(context.Background(), tmpDir, files, tt.rules)
+
+			moved := targets["iso_files"]
+			if len(moved) != len(tt.expectMoved) {
+				t.Errorf("expected %v to be moved, got %v", tt.expectMoved, moved)
+			}
+			for _, name := range tt.expectMoved {
+				if !contains(moved, name) {
+					t.Errorf("expected %s to be moved, got %v", name, moved)
+				}
+			}
+			if len(deferred) != len(tt.expectDeferred) {
+				t.Errorf("expected %v to be deferred, got %+v", tt.expectDeferred, deferred)
+			}
+			for _, this := range deferred {
+				if !contains(tt.expectDeferred, this.File) || this.Reason == "" {
+					t.Errorf("unexpected deferred file %+v", this)
+				}
+				// Young files settle once they're MinAge old, so they can be tried again then.
+				if now := time.Now(); this.SettlesAt.Before(now) || this.SettlesAt.After(now.Add(tt.rules.MinAge)) {
+					t.Errorf("expected %s to settle within %v, got %v", this.File, tt.rules.MinAge, this.SettlesAt)
+				}
+			}
+			if sleepCount != tt.expectSleepCount {
+				t.Errorf("expected %d sleep(s), got %d", tt.expectSleepCount, sleepCount)
+			}
+		})
+	}
+}
+
+func TestGetFilesToMove_Cancelled(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "young.iso"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rules := Rules{MinAge: time.Hour, StabilityInterval: time.Hour}
+	if _, _, err := GetFilesToMove(ctx, tmpDir, files, rules); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled instead of waiting, got %v", err)
+	}
+}
+
+func TestNewRules_Stability(t *testing.T) {
+	rules, err := NewRules(common.Config{MinAge: 30, StabilityInterval: 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rules.MinAge != 30*time.Second || rules.StabilityInterval != 5*time.Second {
+		t.Errorf("expected settings in seconds, got %v and %v", rules.MinAge, rules.StabilityInterval)
+	}
+	if _, err := NewRules(common.Config{MinAge: -1}); err == nil {
+		t.Error("expected error for negative minAge, got nil")
+	}
+	if _, err := NewRules(common.Config{StabilityInterval: 5}); err == nil {
+		t.Error("expected error for stabilityInterval without minAge, got nil")
+	}
+}
+
+func TestGetFilesToMove_PartialDownloads(t *testing.T) {
+	files := []fs.DirEntry{
+		mockDirEntry{name: "movie.mkv"},
+		mockDirEntry{name: "movie.mkv.part"},
+		mockDirEntry{name: "installer.dmg"},
+		mockDirEntry{name: "installer.dmg.crdownload"},
+		mockDirEntry{name: "linux.iso.!qB"},
+		mockDirEntry{name: "notes.txt"},
+	}
+	rules := Rules{ExcludedExtensions: []string{".part"}, PartialSuffixes: common.DefaultPartialSuffixes}
+
+	targets, deferred, _ := GetFilesToMove(context.Background(), "", files, rules)
+
+	if len(targets) != 1 || len(targets["txt_files"]) != 1 {
+		t.Errorf("expected only notes.txt to be moved, got %v", targets)
+	}
+	expectDeferred := map[string]string{
+		"movie.mkv":                "download in progress: movie.mkv.part",
+		"installer.dmg":            "download in progress: installer.dmg.crdownload",
+		"installer.dmg.crdownload": "download in progress",
+		"linux.iso.!qB":            "download in progress",
+	}
+	if len(deferred) != len(expectDeferred) {
+		t.Errorf("expected %d deferred files, got %+v", len(expectDeferred), deferred)
+	}
+	for _, this := range deferred {
+		if reason := expectDeferred[this.File]; reason != this.Reason {
+			t.Errorf("expected %s to be deferred with %q, got %q", this.File, reason, this.Reason)
+		}
+	}
+
+	// Once the browser has finished, the placeholder has become the real file and is moved.
+	targets, deferred, _ = GetFilesToMove(context.Background(), "", []fs.DirEntry{mockDirEntry{name: "movie.mkv"}}, rules)
+	if len(deferred) != 0 || len(targets["mkv_files"]) != 1 {
+		t.Errorf("expected movie.mkv to be moved, got %v and %+v", targets, deferred)
+	}
+}
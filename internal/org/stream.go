@@ -0,0 +1,181 @@
+package org
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// DirReader lists a dir a few entries at a time, as *os.File does.
+type DirReader interface {
+	ReadDir(n int) ([]fs.DirEntry, error)
+}
+
+// ScanChunks lists dir chunkSize entries at a time, and sends each chunk on chunks as soon as it's read. It closes
+// chunks when it's done, and returns what stopped the listing, if it wasn't reaching its end. Entries come in the order
+// the filesystem keeps them, not sorted.
+func ScanChunks(ctx context.Context, dir DirReader, chunkSize int, chunks chan<- []fs.DirEntry) error {
+	defer close(chunks)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entries, err := dir.ReadDir(max(chunkSize, 1))
+		if len(entries) > 0 {
+			select {
+			case chunks <- entries:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// maxHeldBack is how many files ClassifyStream holds back until the listing ends, of each kind: young files waiting to
+// be sampled again, and empty files that may be placeholders. Past it, young files are deferred to a later run and
+// placeholders are looked for on disk, so memory stays flat however many there are. Tests lower it.
+var maxHeldBack = 10000
+
+// ClassifyStream works out where the entries arriving on chunks, which are all in sourcePath, should go, and sends the
+// targets of each chunk on targets as soon as they're known. It closes targets when it's done, and returns the files
+// that may still be being written.
+//
+// It follows the same rules as GetFilesToMove, but only ever holds one chunk, and what it holds back:
+//
+//   - partial downloads are remembered by name as they're listed, and files are checked against those listed so far.
+//     Empty files, which may be placeholders for a partial download that's listed later, are held back until chunks is
+//     closed, so nothing is looked for on disk.
+//   - files younger than rules.MinAge are held back until chunks is closed, and sampled again together, so a listing
+//     waits for rules.StabilityInterval at most once.
+//   - the subdirs in a chunk are walked along with it, if rules.MaxDepth is set, and no dir is walked twice over the
+//     whole listing.
+//
+// Up to maxHeldBack files of each kind are held back. The only error is ctx's.
+func ClassifyStream(
+	ctx context.Context, sourcePath string, chunks <-chan []fs.DirEntry, targets chan<- map[string][]string,
+	rules Rules,
+) (deferred []Deferred, err error) {
+	defer close(targets)
+
+	var young []fs.FileInfo
+	var placeholders []fs.DirEntry
+	partials := make(map[string]bool) // the partial downloads listed so far
+	siblingListed := func(name string) bool { return partials[name] }
+	classifyNow := func(candidates []fs.DirEntry) error {
+		settled, younger, unreadable := rules.splitByAge(candidates)
+		deferred = append(deferred, unreadable...)
+		for _, info := range younger {
+			if len(young) < maxHeldBack {
+				young = append(young, info)
+			} else {
+				deferred = append(deferred, rules.deferYoung(info))
+			}
+		}
+		return rules.sendTargets(ctx, sourcePath, settled, targets)
+	}
+
+	walker := newDirWalker(sourcePath)
+	for files := range chunks {
+		files, err := rules.withNestedFiles(ctx, walker, files)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if rules.isPartial(file.Name()) {
+				partials[file.Name()] = true
+			}
+		}
+
+		candidates, inProgress := rules.candidates(files, siblingListed)
+		deferred = append(deferred, inProgress...)
+		candidates, placeholders, inProgress = rules.holdBackPlaceholders(sourcePath, candidates, placeholders)
+		deferred = append(deferred, inProgress...)
+		if err := classifyNow(candidates); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every partial download has been listed, so the placeholders can be told apart from other empty files.
+	var candidates []fs.DirEntry
+	for _, file := range placeholders {
+		if reason, inProgress := rules.downloadInProgress(file.Name(), siblingListed); inProgress {
+			deferred = append(deferred, Deferred{File: file.Name(), Reason: reason})
+		} else {
+			candidates = append(candidates, file)
+		}
+	}
+	if err := classifyNow(candidates); err != nil {
+		return nil, err
+	}
+
+	settled, unsettled, err := rules.resample(ctx, sourcePath, young)
+	if err != nil {
+		return nil, err
+	}
+	deferred = append(deferred, unsettled...)
+	if err := rules.sendTargets(ctx, sourcePath, settled, targets); err != nil {
+		return nil, err
+	}
+	return deferred, nil
+}
+
+// holdBackPlaceholders moves the empty files among candidates to placeholders, since their partial download may be
+// listed later, and returns the rest. Once placeholders is full, empty files are checked for a partial download on
+// disk instead, and those that have one are returned in inProgress. Each candidate is looked at once, and keeps what
+// was found, so splitByAge doesn't look again.
+func (rules Rules) holdBackPlaceholders(
+	sourcePath string, candidates []fs.DirEntry, placeholders []fs.DirEntry,
+) (rest []fs.DirEntry, held []fs.DirEntry, inProgress []Deferred) {
+	if len(rules.PartialSuffixes) == 0 {
+		return candidates, placeholders, nil
+	}
+	siblingOnDisk := func(name string) bool {
+		_, err := os.Lstat(filepath.Join(sourcePath, name))
+		return err == nil
+	}
+	for _, file := range candidates {
+		info, err := file.Info()
+		if err != nil || info == nil {
+			rest = append(rest, file)
+			continue
+		}
+		file = entryFor(file.Name(), info)
+		if info.Size() > 0 || !info.Mode().IsRegular() {
+			rest = append(rest, file)
+		} else if len(placeholders) < maxHeldBack {
+			placeholders = append(placeholders, file)
+		} else if reason, ok := rules.downloadInProgress(file.Name(), siblingOnDisk); ok {
+			inProgress = append(inProgress, Deferred{File: file.Name(), Reason: reason})
+		} else {
+			rest = append(rest, file)
+		}
+	}
+	return rest, placeholders, inProgress
+}
+
+// sendTargets classifies fileNames and sends them on targets, unless there are none. The only error is ctx's.
+func (rules Rules) sendTargets(
+	ctx context.Context, sourcePath string, fileNames []string, targets chan<- map[string][]string,
+) error {
+	if len(fileNames) == 0 {
+		return nil
+	}
+	chunkTargets := make(map[string][]string)
+	if err := rules.classify(ctx, sourcePath, fileNames, chunkTargets); err != nil {
+		return err
+	}
+	select {
+	case targets <- chunkTargets:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
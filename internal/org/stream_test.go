@@ -0,0 +1,320 @@
+package org
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RMBeristain/organise-downloads/internal/common"
+)
+
+// sliceDirReader hands out entries a few at a time, like *os.File, and then err, or io.EOF if err is nil.
+type sliceDirReader struct {
+	entries []fs.DirEntry
+	err     error
+}
+
+func (reader *sliceDirReader) ReadDir(n int) ([]fs.DirEntry, error) {
+	if len(reader.entries) == 0 {
+		if reader.err != nil {
+			return nil, reader.err
+		}
+		return nil, io.EOF
+	}
+	n = min(n, len(reader.entries))
+	chunk := reader.entries[:n]
+	reader.entries = reader.entries[n:]
+	return chunk, nil
+}
+
+// writeEntry writes a file named name in dir, and returns its entry.
+func writeEntry(t *testing.T, dir, name, contents string) fs.DirEntry {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs.FileInfoToDirEntry(info)
+}
+
+// streamTargets runs ClassifyStream over chunks, and returns every target it sent, merged.
+func streamTargets(t *testing.T, sourcePath string, rules Rules, chunks ...[]fs.DirEntry) (map[string][]string, []Deferred, int) {
+	t.Helper()
+	chunkChan := make(chan []fs.DirEntry, len(chunks))
+	for _, chunk := range chunks {
+		chunkChan <- chunk
+	}
+	close(chunkChan)
+
+	targets := make(chan map[string][]string, len(chunks)+1)
+	deferred, err := ClassifyStream(context.Background(), sourcePath, chunkChan, targets, rules)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	merged := make(map[string][]string)
+	sentCount := 0
+	for chunkTargets := range targets {
+		sentCount++
+		for subDir, files := range chunkTargets {
+			merged[subDir] = append(merged[subDir], files...)
+		}
+	}
+	return merged, deferred, sentCount
+}
+
+func TestScanChunks(t *testing.T) {
+	var entries []fs.DirEntry
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		entries = append(entries, mockDirEntry{name: name})
+	}
+	listingFailed := errors.New("listing failed")
+
+	tests := []struct {
+		name             string
+		reader           *sliceDirReader
+		expectChunkSizes []int
+		expectErr        error
+	}{
+		{"Whole chunks", &sliceDirReader{entries: entries[:4]}, []int{2, 2}, nil},
+		{"Last chunk short", &sliceDirReader{entries: entries}, []int{2, 2, 1}, nil},
+		{"Empty dir", &sliceDirReader{}, nil, nil},
+		{"Listing fails", &sliceDirReader{entries: entries[:3], err: listingFailed}, []int{2, 1}, listingFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := make(chan []fs.DirEntry, 8)
+			err := ScanChunks(context.Background(), tt.reader, 2, chunks)
+			if !errors.Is(err, tt.expectErr) {
+				t.Errorf("expected %v, got %v", tt.expectErr, err)
+			}
+			var chunkSizes []int
+			for chunk := range chunks {
+				chunkSizes = append(chunkSizes, len(chunk))
+			}
+			if len(chunkSizes) != len(tt.expectChunkSizes) {
+				t.Fatalf("expected chunks of %v, got %v", tt.expectChunkSizes, chunkSizes)
+			}
+			for i := range chunkSizes {
+				if chunkSizes[i] != tt.expectChunkSizes[i] {
+					t.Errorf("expected chunks of %v, got %v", tt.expectChunkSizes, chunkSizes)
+				}
+			}
+		})
+	}
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		chunks := make(chan []fs.DirEntry) // nobody reads it: a cancelled scan mustn't block
+		if err := ScanChunks(ctx, &sliceDirReader{entries: entries}, 2, chunks); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	})
+}
+
+func TestClassifyStream(t *testing.T) {
+	t.Run("Partial download in another chunk", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		entries := make(map[string]fs.DirEntry)
+		for name, contents := range map[string]string{"movie.mkv": "", "movie.mkv.part": "data", "notes.txt": "notes"} {
+			entries[name] = writeEntry(t, tmpDir, name, contents)
+		}
+		rules := Rules{PartialSuffixes: common.DefaultPartialSuffixes}
+
+		targets, deferred, sentCount := streamTargets(t, tmpDir, rules,
+			[]fs.DirEntry{entries["movie.mkv"], entries["notes.txt"]},
+			[]fs.DirEntry{entries["movie.mkv.part"]},
+		)
+		if len(targets) != 1 || len(targets["txt_files"]) != 1 {
+			t.Errorf("expected only notes.txt to be moved, got %v", targets)
+		}
+		if len(deferred) != 2 {
+			t.Errorf("expected movie.mkv and movie.mkv.part to be deferred, got %+v", deferred)
+		}
+		if sentCount != 1 {
+			t.Errorf("expected notes.txt to be sent with its chunk, got %d sends", sentCount)
+		}
+	})
+
+	t.Run("Past maxHeldBack", func(t *testing.T) {
+		originalMaxHeldBack := maxHeldBack
+		maxHeldBack = 1
+		t.Cleanup(func() { maxHeldBack = originalMaxHeldBack })
+		tmpDir := t.TempDir()
+		var files []fs.DirEntry
+		for _, name := range []string{"a.mkv", "b.mkv", "young1.iso", "young2.iso"} {
+			files = append(files, writeEntry(t, tmpDir, name, ""))
+		}
+		writeEntry(t, tmpDir, "b.mkv.part", "data") // only found on disk, as the placeholders are full
+		rules := Rules{PartialSuffixes: common.DefaultPartialSuffixes, MinAge: time.Minute, StabilityInterval: time.Second}
+
+		sleepCount := 0
+		originalSleep := sleep
+		sleep = func(context.Context, time.Duration) error {
+			sleepCount++
+			return nil
+		}
+		t.Cleanup(func() { sleep = originalSleep })
+
+		_, deferred, _ := streamTargets(t, tmpDir, rules, files)
+		reasons := make(map[string]string)
+		for _, this := range deferred {
+			reasons[this.File] = this.Reason
+		}
+		if reasons["b.mkv"] != "download in progress: b.mkv.part" {
+			t.Errorf("expected b.mkv to be deferred for its partial download, got %+v", deferred)
+		}
+		if !strings.HasPrefix(reasons["young2.iso"], "modified") || sleepCount != 1 {
+			t.Errorf("expected young2.iso to be deferred without sampling, got %+v after %d sleeps", deferred, sleepCount)
+		}
+	})
+
+	t.Run("Young files are sampled once, at the end", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		for _, name := range []string{"old.iso", "young1.iso", "young2.iso"} {
+			if err := os.WriteFile(filepath.Join(tmpDir, name), []byte("data"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		older := time.Now().Add(-time.Hour)
+		if err := os.Chtimes(filepath.Join(tmpDir, "old.iso"), older, older); err != nil {
+			t.Fatal(err)
+		}
+		files, err := os.ReadDir(tmpDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sleepCount := 0
+		originalSleep := sleep
+		sleep = func(context.Context, time.Duration) error {
+			sleepCount++
+			return nil
+		}
+		t.Cleanup(func() { sleep = originalSleep })
+
+		rules := Rules{MinAge: time.Minute, StabilityInterval: time.Second}
+		targets, deferred, sentCount := streamTargets(t, tmpDir, rules, files[:1], files[1:2], files[2:])
+		moved := targets["iso_files"]
+		sort.Strings(moved)
+		if len(moved) != 3 || len(deferred) != 0 {
+			t.Errorf("expected every file to be moved, got %v and %+v", moved, deferred)
+		}
+		if sleepCount != 1 {
+			t.Errorf("expected 1 sleep, got %d", sleepCount)
+		}
+		if sentCount != 2 {
+			t.Errorf("expected the old file and the resampled ones to be sent apart, got %d sends", sentCount)
+		}
+	})
+}
+
+func TestMoveStream(t *testing.T) {
+	tmpDir := t.TempDir()
+	chunks := []map[string][]string{
+		{"txt_files": {"a.txt", "b.txt"}, "pdf_files": {"c.pdf"}},
+		{"txt_files": {"d.txt"}},
+		{"pdf_files": {"e.pdf"}, "txt_files": {"f.txt"}},
+	}
+	for _, chunk := range chunks {
+		for _, files := range chunk {
+			for _, name := range files {
+				if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	targets := make(chan map[string][]string)
+	results := make(chan MoveResult, 6)
+	go func() {
+		for _, chunk := range chunks {
+			targets <- chunk
+		}
+		close(targets)
+	}()
+	MoveStream(context.Background(), tmpDir, targets, results, MoveOptions{Workers: 2})
+
+	bySubDir := make(map[string][]string)
+	for result := range results {
+		if result.Action != ActionMoved {
+			t.Errorf("expected %s to be moved, got %+v", result.File(), result)
+		}
+		bySubDir[result.SubDir] = append(bySubDir[result.SubDir], result.File())
+	}
+	expectOrder := map[string][]string{"txt_files": {"a.txt", "b.txt", "d.txt", "f.txt"}, "pdf_files": {"c.pdf", "e.pdf"}}
+	for subDir, files := range expectOrder {
+		if got := bySubDir[subDir]; len(got) != len(files) {
+			t.Errorf("expected %v in %s, got %v", files, subDir, got)
+		} else {
+			for i := range files {
+				if got[i] != files[i] {
+					t.Errorf("expected %v in order in %s, got %v", files, subDir, got)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestMoveStream_SlowSubdir(t *testing.T) {
+	tmpDir := t.TempDir()
+	chunks := []map[string][]string{
+		{"iso_files": {"slow.iso"}}, {"pdf_files": {"b.pdf"}}, {"txt_files": {"a.txt"}}, {"zip_files": {"c.zip"}},
+	}
+	for _, name := range []string{"slow.iso", "a.txt", "b.pdf", "c.zip"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	release := make(chan struct{})
+	releaseSlowMove := sync.OnceFunc(func() { close(release) })
+	originalRenameFile := renameFile
+	renameFile = func(oldpath, newpath string, replace bool) error {
+		if filepath.Base(newpath) == "slow.iso" {
+			<-release
+		}
+		return originalRenameFile(oldpath, newpath, replace)
+	}
+	t.Cleanup(func() { renameFile = originalRenameFile })
+	t.Cleanup(releaseSlowMove)
+
+	targets := make(chan map[string][]string)
+	results := make(chan MoveResult, 4)
+	go func() {
+		for _, chunk := range chunks {
+			targets <- chunk
+		}
+		close(targets)
+	}()
+	go MoveStream(context.Background(), tmpDir, targets, results, MoveOptions{Workers: 2})
+
+	// The worker stuck on iso_files mustn't hold back the subdirs that come after it.
+	for range 3 {
+		select {
+		case result := <-results:
+			if result.Action != ActionMoved || result.SubDir == "iso_files" {
+				t.Errorf("expected another subdir to be filled first, got %+v", result)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the other subdirs to be filled while one is stuck")
+		}
+	}
+	releaseSlowMove()
+	if result := <-results; result.Action != ActionMoved || result.SubDir != "iso_files" {
+		t.Errorf("expected slow.iso to be moved last, got %+v", result)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package org
+
+import "os"
+
+// visitedDirs is the set of dirs a dirWalker walked. Without device and inode numbers to key them by, dirs are told
+// apart with os.SameFile.
+type visitedDirs struct {
+	dirs sameFileSet
+}
+
+// add adds the dir info describes, and returns false if it was already in the set.
+func (visited *visitedDirs) add(info os.FileInfo) bool {
+	return visited.dirs.add(info)
+}
@@ -0,0 +1,38 @@
+//go:build unix
+
+package org
+
+import (
+	"os"
+	"syscall"
+)
+
+// dirID identifies a dir by the device it's on and its inode.
+type dirID struct {
+	dev uint64
+	ino uint64
+}
+
+// visitedDirs is the set of dirs a dirWalker walked, keyed by device and inode so looking one up takes the same time
+// however many were walked.
+type visitedDirs struct {
+	ids    map[dirID]bool
+	others sameFileSet // dirs whose info has no device and inode, which shouldn't happen
+}
+
+// add adds the dir info describes, and returns false if it was already in the set.
+func (visited *visitedDirs) add(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return visited.others.add(info)
+	}
+	id := dirID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+	if visited.ids[id] {
+		return false
+	}
+	if visited.ids == nil {
+		visited.ids = make(map[dirID]bool)
+	}
+	visited.ids[id] = true
+	return true
+}
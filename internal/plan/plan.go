@@ -0,0 +1,161 @@
+// Serialised move plans that can be reviewed before they're applied
+package plan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Version is the plan file format written by this build. Plans with any other version are rejected.
+const Version = 1
+
+// FileState is what a source file looked like when the plan was made.
+type FileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// Plan is a reviewable list of moves. Targets has the same shape as the map returned by org.GetFilesToMove.
+type Plan struct {
+	Version   int                  `json:"version"`
+	CreatedAt time.Time            `json:"createdAt"`
+	SourceDir string               `json:"sourceDir"`
+	Targets   map[string][]string  `json:"targets"`
+	Files     map[string]FileState `json:"files"` // keyed by file name, relative to SourceDir
+}
+
+// ChangedFile is a file that can't be moved because it no longer matches the plan.
+type ChangedFile struct {
+	File   string
+	Reason string
+}
+
+// New records the size and mtime of every file in targets. Files that are gone by now, say because a download was
+// renamed while the plan was being made, are left out, as there's nothing to move; any other failure to look at a file
+// is an error.
+func New(sourceDir string, targets map[string][]string) (Plan, error) {
+	plan := Plan{
+		Version:   Version,
+		CreatedAt: time.Now(),
+		SourceDir: sourceDir,
+		Targets:   make(map[string][]string),
+		Files:     make(map[string]FileState),
+	}
+
+	for subDir, files := range targets {
+		if len(files) == 0 {
+			continue // dirs, which are never moved
+		}
+		var present []string
+		for _, file := range files {
+			info, err := os.Stat(filepath.Join(sourceDir, file))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return Plan{}, err
+			}
+			present = append(present, file)
+			plan.Files[file] = FileState{Size: info.Size(), ModTime: info.ModTime()}
+		}
+		if len(present) > 0 {
+			plan.Targets[subDir] = present
+		}
+	}
+	return plan, nil
+}
+
+// Encode writes the plan to w as indented JSON.
+func (plan Plan) Encode(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plan)
+}
+
+// Write saves the plan to path, replacing any existing file.
+func (plan Plan) Write(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := plan.Encode(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read loads a plan saved by Write and checks that this build understands it.
+func Read(path string) (Plan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Plan{}, err
+	}
+	defer f.Close()
+
+	var plan Plan
+	if err := json.NewDecoder(f).Decode(&plan); err != nil {
+		return Plan{}, fmt.Errorf("unable to decode plan %s: %w", path, err)
+	}
+	if plan.Version != Version {
+		return Plan{}, fmt.Errorf("unsupported plan version %d in %s (expected %d)", plan.Version, path, Version)
+	}
+	if plan.SourceDir == "" {
+		return Plan{}, fmt.Errorf("plan %s doesn't say which dir it's for", path)
+	}
+	for subDir, files := range plan.Targets {
+		if !isLocalName(subDir) {
+			return Plan{}, fmt.Errorf("invalid subdir %q in plan %s", subDir, path)
+		}
+		for _, file := range files {
+			if !filepath.IsLocal(file) {
+				return Plan{}, fmt.Errorf("invalid file name %q in plan %s", file, path)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// Verify compares every file in the plan against the disk. It returns the targets whose files are unchanged, and the
+// files that were modified, removed or never recorded, which must not be moved.
+func (plan Plan) Verify() (unchanged map[string][]string, changed []ChangedFile, err error) {
+	unchanged = make(map[string][]string)
+
+	for subDir, files := range plan.Targets {
+		for _, file := range files {
+			recorded, ok := plan.Files[file]
+			if !ok {
+				changed = append(changed, ChangedFile{file, "not recorded in plan"})
+				continue
+			}
+
+			info, err := os.Stat(filepath.Join(plan.SourceDir, file))
+			if errors.Is(err, fs.ErrNotExist) {
+				changed = append(changed, ChangedFile{file, "no longer exists"})
+				continue
+			} else if err != nil {
+				return nil, nil, err
+			}
+
+			if info.Size() != recorded.Size {
+				changed = append(changed, ChangedFile{file, fmt.Sprintf("size changed from %d to %d", recorded.Size, info.Size())})
+			} else if !info.ModTime().Equal(recorded.ModTime) {
+				changed = append(changed, ChangedFile{file, "modified since the plan was made"})
+			} else {
+				unchanged[subDir] = append(unchanged[subDir], file)
+			}
+		}
+	}
+	return unchanged, changed, nil
+}
+
+// isLocalName returns whether name refers to an entry directly inside the source dir, so a hand-edited plan can't move
+// files from, or into, anywhere else.
+func isLocalName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
@@ -0,0 +1,145 @@
+package plan
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupPlan writes the given files to a temp dir and returns a plan that moves all of them into 'txt_files'.
+func setupPlan(t *testing.T, files ...string) Plan {
+	t.Helper()
+	sourceDir := t.TempDir()
+	for _, name := range files {
+		if err := os.WriteFile(filepath.Join(sourceDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plan, err := New(sourceDir, map[string][]string{"txt_files": files, "some_dir": {}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return plan
+}
+
+func TestNew(t *testing.T) {
+	plan := setupPlan(t, "a.txt", "bb.txt")
+
+	if plan.Version != Version {
+		t.Errorf("expected version %d, got %d", Version, plan.Version)
+	}
+	if _, ok := plan.Targets["some_dir"]; ok {
+		t.Error("expected empty targets to be left out of the plan")
+	}
+	if plan.Files["bb.txt"].Size != int64(len("bb.txt")) {
+		t.Errorf("expected size of bb.txt to be recorded, got %v", plan.Files["bb.txt"])
+	}
+
+	t.Run("Missing file", func(t *testing.T) {
+		sourceDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(sourceDir, "here.txt"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		plan, err := New(sourceDir, map[string][]string{"txt_files": {"gone.txt", "here.txt"}, "pdf_files": {"gone.pdf"}})
+		if err != nil {
+			t.Fatalf("expected a file that's gone to be left out, got %v", err)
+		}
+		if len(plan.Targets) != 1 || len(plan.Targets["txt_files"]) != 1 || len(plan.Files) != 1 {
+			t.Errorf("expected only here.txt in the plan, got %+v", plan)
+		}
+	})
+
+	t.Run("Unreadable file", func(t *testing.T) {
+		sourceDir := t.TempDir()
+		lockedDir := filepath.Join(sourceDir, "locked")
+		if err := os.Mkdir(lockedDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(lockedDir, "a.txt"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(lockedDir, 0); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Chmod(lockedDir, 0755) })
+		if _, err := os.Stat(filepath.Join(lockedDir, "a.txt")); err == nil {
+			t.Skip("permissions aren't enforced here")
+		}
+
+		if _, err := New(sourceDir, map[string][]string{"txt_files": {filepath.Join("locked", "a.txt")}}); err == nil {
+			t.Error("expected error for a file that can't be looked at, got nil")
+		}
+	})
+}
+
+func TestWriteAndRead(t *testing.T) {
+	plan := setupPlan(t, "a.txt")
+	path := filepath.Join(t.TempDir(), "plan.json")
+
+	if err := plan.Write(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := Read(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.SourceDir != plan.SourceDir || len(got.Targets["txt_files"]) != 1 {
+		t.Errorf("expected %+v, got %+v", plan, got)
+	}
+	if !got.Files["a.txt"].ModTime.Equal(plan.Files["a.txt"].ModTime) {
+		t.Errorf("expected mtime to survive a round trip, got %v", got.Files["a.txt"].ModTime)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		errText string
+	}{
+		{"Wrong version", `{"version": 99, "sourceDir": "/tmp"}`, "unsupported plan version"},
+		{"No source dir", `{"version": 1}`, "doesn't say which dir"},
+		{"File outside source dir", `{"version": 1, "sourceDir": "/tmp", "targets": {"x": ["../a"]}}`, "invalid file name"},
+		{"Nested file outside source dir", `{"version": 1, "sourceDir": "/tmp", "targets": {"x": ["sub/../../a"]}}`, "invalid file name"},
+		{"Not JSON", `not a plan`, "unable to decode"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "plan.json")
+			if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Read(path)
+			if err == nil || !strings.Contains(err.Error(), tc.errText) {
+				t.Errorf("expected error containing %q, got %v", tc.errText, err)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	plan := setupPlan(t, "same.txt", "grown.txt", "touched.txt", "gone.txt")
+
+	if err := os.WriteFile(filepath.Join(plan.SourceDir, "grown.txt"), []byte("much longer content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(plan.SourceDir, "touched.txt"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(plan.SourceDir, "gone.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	unchanged, changed, err := plan.Verify()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(unchanged["txt_files"]) != 1 || unchanged["txt_files"][0] != "same.txt" {
+		t.Errorf("expected only same.txt to be unchanged, got %v", unchanged)
+	}
+	if len(changed) != 3 {
+		t.Errorf("expected 3 changed files, got %v", changed)
+	}
+}
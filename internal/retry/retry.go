@@ -0,0 +1,161 @@
+// Files to try moving again later, with exponential backoff
+package retry
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// FileName is the name of the queue file inside the state dir.
+const FileName = "retry.json"
+
+const (
+	BaseDelay = 30 * time.Second // wait before the first retry; it doubles with every failed attempt
+	MaxDelay  = time.Hour        // the longest wait between attempts
+)
+
+// Item is a file in the downloads dir that couldn't be moved, and when to try again.
+type Item struct {
+	File      string    `json:"file"`
+	Attempts  int       `json:"attempts"`
+	NextTry   time.Time `json:"nextTry"`
+	LastError string    `json:"lastError"`
+}
+
+// Queue holds the files waiting to be retried, keyed by file name. It's not safe for concurrent use.
+type Queue struct {
+	path  string
+	items map[string]Item
+}
+
+// New returns an empty queue that's saved at path.
+func New(path string) *Queue {
+	return &Queue{path: path, items: make(map[string]Item)}
+}
+
+// Load reads the queue saved at path. A missing file is an empty queue.
+func Load(path string) (*Queue, error) {
+	queue := New(path)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return queue, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var items []Item
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		queue.items[item.File] = item
+	}
+	return queue, nil
+}
+
+// Save writes the queue to its file, replacing the previous version atomically.
+func (queue *Queue) Save() error {
+	items := queue.Items()
+	if items == nil {
+		items = []Item{} // save '[]' rather than 'null'
+	}
+	data, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(queue.path), FileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name()) // fails harmlessly once renamed
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), queue.path)
+}
+
+// Failed records another failed attempt to move file, and schedules the next one.
+func (queue *Queue) Failed(file string, err error, now time.Time) Item {
+	item := queue.items[file]
+	item.File = file
+	item.Attempts++
+	item.NextTry = now.Add(Backoff(item.Attempts))
+	item.LastError = err.Error()
+	queue.items[file] = item
+	return item
+}
+
+// Schedule records that file should be tried again at, for example once it's old enough to be moved. Unlike Failed,
+// it doesn't count as an attempt.
+func (queue *Queue) Schedule(file string, at time.Time, reason string) Item {
+	item := queue.items[file]
+	item.File = file
+	item.NextTry = at
+	item.LastError = reason
+	queue.items[file] = item
+	return item
+}
+
+// Succeeded removes file from the queue, if it's there.
+func (queue *Queue) Succeeded(file string) {
+	delete(queue.items, file)
+}
+
+// Waiting returns whether file is queued and its next attempt isn't due yet at now.
+func (queue *Queue) Waiting(file string, now time.Time) bool {
+	item, ok := queue.items[file]
+	return ok && now.Before(item.NextTry)
+}
+
+// Due returns the names of the files whose next attempt is due at now.
+func (queue *Queue) Due(now time.Time) []string {
+	var files []string
+	for _, item := range queue.items {
+		if !now.Before(item.NextTry) {
+			files = append(files, item.File)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// NextTry returns when the earliest attempt is due, or false if the queue is empty.
+func (queue *Queue) NextTry() (time.Time, bool) {
+	var next time.Time
+	for _, item := range queue.items {
+		if next.IsZero() || item.NextTry.Before(next) {
+			next = item.NextTry
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Items returns every queued item, sorted by file name.
+func (queue *Queue) Items() []Item {
+	var items []Item
+	for _, item := range queue.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].File < items[j].File })
+	return items
+}
+
+// Backoff returns how long to wait after the given number of failed attempts.
+func Backoff(attempts int) time.Duration {
+	delay := BaseDelay
+	for i := 1; i < attempts && delay < MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, MaxDelay)
+}
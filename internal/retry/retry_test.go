@@ -0,0 +1,79 @@
+package retry
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	queue, err := Load(path)
+	if err != nil {
+		t.Fatalf("expected a missing file to be an empty queue, got %v", err)
+	}
+	if _, ok := queue.NextTry(); ok {
+		t.Error("expected no next try for an empty queue")
+	}
+
+	now := time.Date(2026, 1, 7, 10, 0, 0, 0, time.UTC)
+	queue.Failed("busy.iso", errors.New("file is in use"), now)
+	item := queue.Failed("busy.iso", errors.New("file is in use"), now)
+	queue.Failed("locked.pdf", errors.New("permission denied"), now)
+	if item.Attempts != 2 || !item.NextTry.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected 2nd attempt a minute later, got %+v", item)
+	}
+
+	if !queue.Waiting("busy.iso", now) || queue.Waiting("other.txt", now) {
+		t.Error("expected only queued files to be waiting")
+	}
+	if due := queue.Due(now.Add(45 * time.Second)); len(due) != 1 || due[0] != "locked.pdf" {
+		t.Errorf("expected only locked.pdf to be due, got %v", due)
+	}
+	if next, _ := queue.NextTry(); !next.Equal(now.Add(BaseDelay)) {
+		t.Errorf("expected the next try after %v, got %v", BaseDelay, next)
+	}
+
+	// A file that's only too young to move is tried again when it's old enough, without backing off.
+	item = queue.Schedule("new.pdf", now.Add(10*time.Second), "modified 50s ago")
+	if item.Attempts != 0 || !queue.Waiting("new.pdf", now) {
+		t.Errorf("expected new.pdf to wait without an attempt, got %+v", item)
+	}
+	if next, _ := queue.NextTry(); !next.Equal(now.Add(10 * time.Second)) {
+		t.Errorf("expected the next try to be new.pdf's, got %v", next)
+	}
+	queue.Succeeded("new.pdf")
+
+	// Retries survive a restart.
+	queue.Succeeded("locked.pdf")
+	if err := queue.Save(); err != nil {
+		t.Fatalf("unable to save: %v", err)
+	}
+	reloaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("unable to load: %v", err)
+	}
+	items := reloaded.Items()
+	if len(items) != 1 || items[0].File != "busy.iso" || items[0].Attempts != 2 || items[0].LastError != "file is in use" {
+		t.Errorf("expected busy.iso to be reloaded, got %+v", items)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{8, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, tt := range tests {
+		if delay := Backoff(tt.attempts); delay != tt.expected {
+			t.Errorf("expected %v after %d attempts, got %v", tt.expected, tt.attempts, delay)
+		}
+	}
+}
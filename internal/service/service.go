@@ -0,0 +1,265 @@
+// Installing organise-downloads as a scheduled user service
+package service
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Target is the service manager the files are written for.
+type Target string
+
+const (
+	TargetSystemd Target = "systemd" // a systemd user service and timer, on Linux
+	TargetLaunchd Target = "launchd" // a launchd user agent, on macOS
+)
+
+const (
+	unitName        = "organise-downloads"
+	launchdLabel    = "com.user.organise-downloads"
+	systemdDir      = ".config/systemd/user"
+	launchAgentsDir = "Library/LaunchAgents"
+)
+
+// Config describes the service to install.
+type Config struct {
+	HomeDir    string        // the user's home dir; every file is written below it
+	Executable string        // absolute path of the organise-downloads binary
+	Args       []string      // flags passed to the binary on every run
+	Interval   time.Duration // time between runs; at least a second
+}
+
+// File is a file that makes up the service, and what it should contain.
+type File struct {
+	Path    string
+	Content []byte
+}
+
+// FileStatus says whether one of the service's files is installed.
+type FileStatus struct {
+	Path      string
+	Installed bool
+}
+
+// ParseTarget converts a value from the command line into a Target. An empty value means the target for this system.
+func ParseTarget(value string) (Target, error) {
+	switch target := Target(value); target {
+	case "":
+		if runtime.GOOS == "darwin" {
+			return TargetLaunchd, nil
+		}
+		return TargetSystemd, nil
+	case TargetSystemd, TargetLaunchd:
+		return target, nil
+	}
+	return "", fmt.Errorf("unknown service target %q (expected %q or %q)", value, TargetSystemd, TargetLaunchd)
+}
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"systemdArg": systemdArg,
+	"xml":        xmlEscape,
+	"seconds":    func(d time.Duration) int64 { return int64(d / time.Second) },
+}).Parse(`
+{{- define "service" -}}
+[Unit]
+Description=Organise Downloads folder by extension
+
+[Service]
+Type=oneshot
+ExecStart={{systemdArg .Executable}}{{range .Args}} {{systemdArg .}}{{end}}
+# Another instance was already running: not a failure.
+SuccessExitStatus=75
+
+[Install]
+WantedBy=default.target
+{{end}}
+
+{{- define "timer" -}}
+[Unit]
+Description=Run organise-downloads every {{.Interval}}
+
+[Timer]
+OnActiveSec=1min
+OnUnitActiveSec={{seconds .Interval}}s
+Unit=organise-downloads.service
+
+[Install]
+WantedBy=timers.target
+{{end}}
+
+{{- define "plist" -}}
+<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key>
+    <string>com.user.organise-downloads</string>
+    <key>ProgramArguments</key>
+    <array>
+        <string>{{xml .Executable}}</string>
+{{- range .Args}}
+        <string>{{xml .}}</string>
+{{- end}}
+    </array>
+    <key>StartInterval</key>
+    <integer>{{seconds .Interval}}</integer>
+    <key>RunAtLoad</key>
+    <true/>
+</dict>
+</plist>
+{{end}}`))
+
+// Files renders the files of the service for target, without writing them.
+func Files(target Target, config Config) ([]File, error) {
+	if !filepath.IsAbs(config.Executable) {
+		return nil, fmt.Errorf("executable path %q must be absolute", config.Executable)
+	}
+	if config.Interval < time.Second {
+		return nil, fmt.Errorf("interval %v must be at least a second", config.Interval)
+	}
+
+	var names []string // template names, in the same order as paths
+	paths := Paths(target, config.HomeDir)
+	switch target {
+	case TargetSystemd:
+		names = []string{"service", "timer"}
+	case TargetLaunchd:
+		names = []string{"plist"}
+	default:
+		return nil, fmt.Errorf("unknown service target %q", target)
+	}
+
+	files := make([]File, 0, len(names))
+	for i, name := range names {
+		var content bytes.Buffer
+		if err := templates.ExecuteTemplate(&content, name, config); err != nil {
+			return nil, err
+		}
+		files = append(files, File{Path: paths[i], Content: content.Bytes()})
+	}
+	return files, nil
+}
+
+// Paths returns where the files of the service for target live below homeDir.
+func Paths(target Target, homeDir string) []string {
+	switch target {
+	case TargetSystemd:
+		return []string{
+			filepath.Join(homeDir, systemdDir, unitName+".service"),
+			filepath.Join(homeDir, systemdDir, unitName+".timer"),
+		}
+	case TargetLaunchd:
+		return []string{filepath.Join(homeDir, launchAgentsDir, launchdLabel+".plist")}
+	}
+	return nil
+}
+
+// Install writes the files of the service for target, replacing any previous version, and returns them.
+func Install(target Target, config Config) ([]File, error) {
+	files, err := Files(target, config)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Dir(file.Path), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(file.Path, file.Content, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Uninstall removes the files of the service for target, including the link systemd creates when the timer is enabled,
+// and returns the paths that were removed. Files that aren't there are ignored.
+func Uninstall(target Target, homeDir string) ([]string, error) {
+	paths := Paths(target, homeDir)
+	if target == TargetSystemd {
+		paths = append(paths, filepath.Join(homeDir, systemdDir, "timers.target.wants", unitName+".timer"))
+	}
+
+	var removed []string
+	for _, path := range paths {
+		err := os.Remove(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// Status reports which files of the service for target are installed.
+func Status(target Target, homeDir string) ([]FileStatus, error) {
+	var statuses []FileStatus
+	for _, path := range Paths(target, homeDir) {
+		_, err := os.Lstat(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		statuses = append(statuses, FileStatus{Path: path, Installed: err == nil})
+	}
+	return statuses, nil
+}
+
+// InstallCommands returns the commands that start the service once its files are installed.
+func InstallCommands(target Target, homeDir string) []string {
+	if target == TargetLaunchd {
+		return []string{"launchctl load -w " + Paths(target, homeDir)[0]}
+	}
+	return []string{
+		"systemctl --user daemon-reload",
+		"systemctl --user enable --now " + unitName + ".timer",
+	}
+}
+
+// UninstallCommands returns the commands that stop the service once its files are removed.
+func UninstallCommands(target Target) []string {
+	if target == TargetLaunchd {
+		return []string{"launchctl remove " + launchdLabel}
+	}
+	return []string{
+		"systemctl --user stop " + unitName + ".timer",
+		"systemctl --user daemon-reload",
+	}
+}
+
+// StatusCommands returns the commands that show whether the service is running.
+func StatusCommands(target Target) []string {
+	if target == TargetLaunchd {
+		return []string{"launchctl list " + launchdLabel}
+	}
+	return []string{"systemctl --user list-timers " + unitName + ".timer"}
+}
+
+// systemdArg quotes an argument for an ExecStart line, escaping what systemd would otherwise expand.
+func systemdArg(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	arg = strings.ReplaceAll(arg, "$", "$$")
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	arg = strings.ReplaceAll(arg, `\`, `\\`)
+	arg = strings.ReplaceAll(arg, `"`, `\"`)
+	return `"` + arg + `"`
+}
+
+// xmlEscape escapes text for use inside an XML element.
+func xmlEscape(text string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(text))
+	return escaped.String()
+}
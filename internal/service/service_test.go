@@ -0,0 +1,124 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstall(t *testing.T) {
+	config := Config{
+		Executable: "/opt/organise downloads/organise-downloads",
+		Args:       []string{"-downloads", "/home/me/Downloads", "-excludeExtensions", "/home/me/100%.toml", "-loglevel", "1"},
+		Interval:   20 * time.Minute,
+	}
+
+	tests := []struct {
+		target       Target
+		expectPaths  []string
+		expectInFile map[string][]string // file name -> lines it must contain
+	}{
+		{
+			target: TargetSystemd,
+			expectPaths: []string{
+				".config/systemd/user/organise-downloads.service",
+				".config/systemd/user/organise-downloads.timer",
+			},
+			expectInFile: map[string][]string{
+				"organise-downloads.service": {
+					`ExecStart="/opt/organise downloads/organise-downloads" -downloads /home/me/Downloads ` +
+						`-excludeExtensions /home/me/100%%.toml -loglevel 1`,
+					"SuccessExitStatus=75",
+				},
+				"organise-downloads.timer": {"OnUnitActiveSec=1200s", "Unit=organise-downloads.service"},
+			},
+		},
+		{
+			target:      TargetLaunchd,
+			expectPaths: []string{"Library/LaunchAgents/com.user.organise-downloads.plist"},
+			expectInFile: map[string][]string{
+				"com.user.organise-downloads.plist": {
+					"<string>/opt/organise downloads/organise-downloads</string>",
+					"<string>/home/me/100%.toml</string>",
+					"<integer>1200</integer>",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.target), func(t *testing.T) {
+			homeDir := t.TempDir()
+			config := config
+			config.HomeDir = homeDir
+
+			files, err := Install(tt.target, config)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(files) != len(tt.expectPaths) {
+				t.Fatalf("expected %d files, got %d", len(tt.expectPaths), len(files))
+			}
+			for i, file := range files {
+				if expected := filepath.Join(homeDir, tt.expectPaths[i]); file.Path != expected {
+					t.Errorf("expected %s, got %s", expected, file.Path)
+				}
+				content, err := os.ReadFile(file.Path)
+				if err != nil {
+					t.Fatalf("expected file to be written, got %v", err)
+				}
+				for _, line := range tt.expectInFile[filepath.Base(file.Path)] {
+					if !strings.Contains(string(content), line) {
+						t.Errorf("expected %s to contain %q, got:\n%s", file.Path, line, content)
+					}
+				}
+			}
+
+			for _, status := range mustStatus(t, tt.target, homeDir) {
+				if !status.Installed {
+					t.Errorf("expected %s to be installed", status.Path)
+				}
+			}
+
+			removed, err := Uninstall(tt.target, homeDir)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(removed) != len(files) {
+				t.Errorf("expected %d files to be removed, got %v", len(files), removed)
+			}
+			for _, status := range mustStatus(t, tt.target, homeDir) {
+				if status.Installed {
+					t.Errorf("expected %s to be removed", status.Path)
+				}
+			}
+		})
+	}
+}
+
+func TestInstall_Invalid(t *testing.T) {
+	homeDir := t.TempDir()
+	if _, err := Install(TargetSystemd, Config{HomeDir: homeDir, Executable: "organise-downloads", Interval: time.Minute}); err == nil {
+		t.Error("expected error for a relative executable path, got nil")
+	}
+	if _, err := Install(TargetSystemd, Config{HomeDir: homeDir, Executable: "/bin/od", Interval: time.Millisecond}); err == nil {
+		t.Error("expected error for an interval under a second, got nil")
+	}
+	if _, err := ParseTarget("cron"); err == nil {
+		t.Error("expected error for unknown target, got nil")
+	}
+	if entries, _ := os.ReadDir(homeDir); len(entries) != 0 {
+		t.Errorf("expected nothing to be written, got %v", entries)
+	}
+}
+
+func mustStatus(t *testing.T, target Target, homeDir string) []FileStatus {
+	t.Helper()
+	statuses, err := Status(target, homeDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return statuses
+}
@@ -0,0 +1,60 @@
+// Watching the downloads dir for new files
+package watch
+
+import (
+	"time"
+)
+
+// Event is either a file in the watched dir that was finished, by being closed after writing or moved in, a dir that
+// was created or moved in if Dir is true, or, if Overflow is true, a sign that events were lost and the whole dir must
+// be scanned again.
+type Event struct {
+	Name     string // file or dir name inside the watched dir; empty if Overflow
+	Dir      bool
+	Overflow bool
+}
+
+// Debounce passes on each file's event once no new events arrived for that file for delay, so a file that's written
+// and closed several times in a row is only handled once. Overflow events are passed on straight away and drop the
+// pending file events, as the rescan that follows covers them. The returned channel is closed after events is.
+func Debounce(events <-chan Event, delay time.Duration) <-chan Event {
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		deadlines := make(map[Event]time.Time)
+		timer := time.NewTimer(delay)
+		timer.Stop()
+
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				if event.Overflow {
+					clear(deadlines)
+					out <- event
+					continue
+				}
+				deadlines[event] = time.Now().Add(delay)
+			case <-timer.C:
+			}
+
+			// Send the files that have been quiet long enough, and wait for the next one that will be.
+			var next time.Time
+			for event, deadline := range deadlines {
+				if !time.Now().Before(deadline) {
+					delete(deadlines, event)
+					out <- event
+				} else if next.IsZero() || deadline.Before(next) {
+					next = deadline
+				}
+			}
+			timer.Stop()
+			if !next.IsZero() {
+				timer.Reset(time.Until(next))
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,128 @@
+//go:build linux
+
+package watch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Watcher reports files that are finished in a dir, and dirs that appear in it, using inotify. Subdirs aren't watched.
+type Watcher struct {
+	dir     string
+	file    *os.File
+	events  chan Event
+	done    chan struct{}
+	stopped chan struct{} // closed once read returns
+	close   sync.Once
+	err     error
+}
+
+// New starts watching dir for files that are closed after writing (IN_CLOSE_WRITE) or moved in (IN_MOVED_TO), and for
+// dirs that are created (IN_CREATE) or moved in.
+func New(dir string) (*Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start inotify: %w", err)
+	}
+	mask := uint32(unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_ONLYDIR | unix.IN_DELETE_SELF |
+		unix.IN_MOVE_SELF)
+	if _, err := unix.InotifyAddWatch(fd, dir, mask); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("unable to watch %s: %w", dir, err)
+	}
+
+	// The fd is non-blocking, so reads go through the runtime poller and Close can interrupt them.
+	w := &Watcher{
+		dir:     dir,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		events:  make(chan Event),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.read()
+	return w, nil
+}
+
+// Events returns the channel events are sent on. It's closed when the Watcher is closed or fails; Err says why.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Err returns the error that stopped the Watcher, or nil if it was closed. It's only set once Events is closed, or
+// Close has returned.
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+// Close stops watching, and returns once the Watcher has stopped.
+func (w *Watcher) Close() (err error) {
+	w.close.Do(func() {
+		close(w.done)
+		err = w.file.Close()
+	})
+	<-w.stopped
+	return err
+}
+
+// send passes event on, unless the Watcher is closed first.
+func (w *Watcher) send(event Event) bool {
+	select {
+	case w.events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// read decodes inotify events until the fd is closed or the watched dir goes away.
+func (w *Watcher) read() {
+	defer close(w.stopped)
+	defer close(w.events)
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+
+	for {
+		n, err := w.file.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return
+		}
+		if err != nil {
+			w.err = err
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(raw.Len)]
+			offset += unix.SizeofInotifyEvent + int(raw.Len)
+
+			switch {
+			case raw.Mask&unix.IN_Q_OVERFLOW != 0:
+				if !w.send(Event{Overflow: true}) {
+					return
+				}
+			case raw.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF|unix.IN_IGNORED) != 0:
+				w.err = fmt.Errorf("%s was removed or moved", w.dir)
+				return
+			case raw.Mask&unix.IN_ISDIR != 0:
+				// Reported as soon as it appears, so a recursive run can organise the files already in it.
+				isNew := raw.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0
+				if isNew && !w.send(Event{Name: string(bytes.TrimRight(nameBytes, "\x00")), Dir: true}) {
+					return
+				}
+			case raw.Mask&unix.IN_CREATE != 0:
+				// A new file is reported once it's finished.
+			default:
+				if !w.send(Event{Name: string(bytes.TrimRight(nameBytes, "\x00"))}) {
+					return
+				}
+			}
+		}
+	}
+}
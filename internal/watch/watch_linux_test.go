@@ -0,0 +1,96 @@
+//go:build linux
+
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	watcher, err := New(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer watcher.Close()
+
+	next := func() Event {
+		t.Helper()
+		select {
+		case event, ok := <-watcher.Events():
+			if !ok {
+				t.Fatalf("events closed: %v", watcher.Err())
+			}
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+		return Event{}
+	}
+
+	// Closing a file after writing it.
+	if err := os.WriteFile(filepath.Join(dir, "written.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if event := next(); event.Name != "written.txt" {
+		t.Errorf("expected written.txt, got %+v", event)
+	}
+
+	// Creating a dir, as unpacking an archive does.
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if event := next(); event.Name != "subdir" || !event.Dir {
+		t.Errorf("expected subdir, got %+v", event)
+	}
+
+	// Moving a file in, the way browsers finish a download.
+	otherDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(otherDir, "movie.mkv.part"), []byte("movie"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(otherDir, "movie.mkv.part"), filepath.Join(dir, "movie.mkv")); err != nil {
+		t.Fatal(err)
+	}
+	if event := next(); event.Name != "movie.mkv" {
+		t.Errorf("expected movie.mkv, got %+v", event)
+	}
+
+	t.Run("Watched dir removed", func(t *testing.T) {
+		gone := t.TempDir()
+		goneWatcher, err := New(gone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer goneWatcher.Close()
+		if err := os.Remove(gone); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case _, ok := <-goneWatcher.Events():
+			if ok || goneWatcher.Err() == nil {
+				t.Errorf("expected events to stop with an error, got %v", goneWatcher.Err())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the watcher to stop")
+		}
+	})
+
+	if err := watcher.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := watcher.Err(); err != nil {
+		t.Errorf("expected no error once closed, got %v", err)
+	}
+	select {
+	case _, ok := <-watcher.Events():
+		if ok {
+			t.Error("expected events to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for events to be closed")
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package watch
+
+import "errors"
+
+// Watcher reports files that are finished in a dir. It's only implemented on Linux.
+type Watcher struct{}
+
+// New returns an error, as watching needs inotify.
+func New(dir string) (*Watcher, error) {
+	return nil, errors.New("watch mode needs inotify, which is only available on Linux")
+}
+
+// Events returns nil.
+func (w *Watcher) Events() <-chan Event {
+	return nil
+}
+
+// Err returns nil.
+func (w *Watcher) Err() error {
+	return nil
+}
+
+// Close does nothing.
+func (w *Watcher) Close() error {
+	return nil
+}
@@ -0,0 +1,53 @@
+package watch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDebounce(t *testing.T) {
+	events := make(chan Event)
+	debounced := Debounce(events, 50*time.Millisecond)
+
+	// A file written in several bursts is only reported once, after the last one.
+	start := time.Now()
+	for range 3 {
+		events <- Event{Name: "movie.mkv"}
+		time.Sleep(20 * time.Millisecond)
+	}
+	events <- Event{Name: "notes.txt"}
+
+	received := make(map[string]int)
+	for range 2 {
+		select {
+		case event := <-debounced:
+			received[event.Name]++
+		case <-time.After(time.Second):
+			t.Fatalf("timed out; got %v", received)
+		}
+	}
+	if received["movie.mkv"] != 1 || received["notes.txt"] != 1 {
+		t.Errorf("expected one event per file, got %v", received)
+	}
+	if elapsed := time.Since(start); elapsed < 110*time.Millisecond {
+		t.Errorf("expected events to wait for the files to be quiet, got them after %v", elapsed)
+	}
+
+	t.Run("Overflow", func(t *testing.T) {
+		events <- Event{Name: "pending.txt"}
+		events <- Event{Overflow: true}
+		if event := <-debounced; !event.Overflow {
+			t.Fatalf("expected the overflow first, got %+v", event)
+		}
+		select {
+		case event := <-debounced:
+			t.Errorf("expected pending files to be dropped after an overflow, got %+v", event)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	close(events)
+	if _, ok := <-debounced; ok {
+		t.Error("expected the output to be closed with the input")
+	}
+}
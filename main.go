@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/RMBeristain/organise-downloads/internal/common"
+	"github.com/RMBeristain/organise-downloads/internal/lock"
 	"github.com/RMBeristain/organise-downloads/internal/logging"
-	"github.com/RMBeristain/organise-downloads/internal/org"
+	"github.com/RMBeristain/organise-downloads/organiser"
 	"github.com/rs/zerolog"
 )
 
@@ -16,24 +22,293 @@ var (
 	defaultSrcDir string = "Downloads"
 )
 
-func main() {
-	var workingSrcDir string
+// exitFailed is the exit code when at least one file couldn't be moved.
+const exitFailed = 1
 
-	startTime := time.Now()
+// exitInterrupted is the exit code when SIGINT or SIGTERM stopped a run before it was done: 128 plus SIGINT's number,
+// as shells report it.
+const exitInterrupted = 130
+
+// exitLocked is the exit code when another instance is already running. It's EX_TEMPFAIL from sysexits.h: try again
+// later.
+const exitLocked = 75
 
-	pDownloadDir := flag.String("downloads", defaultSrcDir, "Full path to Downloads dir")
-	pNewLogLevel := flag.Int("loglevel", int(zerolog.InfoLevel), "Use this log level [0:3]")
-	pExcludedExtensions := flag.String("excludeExtensions", "", "Path to TOML file with excluded extensions")
-	pGenerateSample := flag.String("generateSampleTomlFile", "", "Generate a sample TOML file at the specified path and exit")
-	flag.Parse() // read command line flags
+// cliOptions holds the flags shared by every command.
+type cliOptions struct {
+	downloadDir   string
+	logLevel      int
+	configPath    string
+	dedupe        string
+	lockWait      time.Duration
+	logMaxSize    int // megabytes
+	logMaxAge     time.Duration
+	logKeep       int
+	logCompress   bool
+	logSink       string
+	logFile       string
+	logFormat     string
+	logCaller     bool
+	workers       int
+	recursive     bool
+	maxDepth      int
+	preservePaths bool
+	flagSet       *flag.FlagSet // to tell which flags were set, and so override TOML
+	runID         string        // if set, the journal run every move is recorded under; not a flag
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "plan":
+			runPlan(os.Args[2:])
+			return
+		case "apply":
+			runApply(os.Args[2:])
+			return
+		case "undo":
+			runUndo(os.Args[2:])
+			return
+		case "watch":
+			runWatch(os.Args[2:])
+			return
+		case "daemon":
+			runDaemon(os.Args[2:])
+			return
+		case "service":
+			runService(os.Args[2:])
+			return
+		}
+	}
+	runOrganise(os.Args[1:])
+}
+
+// addCommonFlags registers the flags shared by every command on flagSet.
+func addCommonFlags(flagSet *flag.FlagSet) *cliOptions {
+	options := &cliOptions{flagSet: flagSet}
+	flagSet.StringVar(&options.downloadDir, "downloads", defaultSrcDir, "Full path to Downloads dir")
+	flagSet.IntVar(&options.logLevel, "loglevel", int(zerolog.InfoLevel), "Use this log level [0:3]")
+	flagSet.StringVar(&options.configPath, "excludeExtensions", "", "Path to TOML file with excluded extensions and categories")
+	flagSet.StringVar(&options.dedupe, "dedupe", "", "Look for duplicate files: off, report, trash or hardlink (overrides TOML)")
+	flagSet.DurationVar(&options.lockWait, "wait", 0, "If another instance is running, wait this long for it to finish")
+	flagSet.IntVar(&options.logMaxSize, "logMaxSize", common.DefaultLogConfig.MaxSizeMB, "Rotate the log file at this many MB; 0 for no limit (overrides TOML)")
+	flagSet.DurationVar(&options.logMaxAge, "logMaxAge", 0, "Rotate the log file once it's this old; 0 for no limit (overrides TOML)")
+	flagSet.IntVar(&options.logKeep, "logKeep", common.DefaultLogConfig.Keep, "Keep this many rotated log files; 0 keeps all (overrides TOML)")
+	flagSet.BoolVar(&options.logCompress, "logCompress", false, "Gzip rotated log files (overrides TOML)")
+	flagSet.StringVar(&options.logSink, "logSink", common.DefaultLogConfig.Sink, "Write logs to file, stderr or both (overrides TOML)")
+	flagSet.StringVar(&options.logFile, "logFile", "", "Path to the log file; defaults to organise-downloads.log in the state dir (overrides TOML)")
+	flagSet.StringVar(&options.logFormat, "logFormat", common.DefaultLogConfig.Format, "Log format: json or pretty (overrides TOML)")
+	flagSet.BoolVar(&options.logCaller, "logCaller", common.DefaultLogConfig.Caller, "Record the file and line of each log entry (overrides TOML)")
+	flagSet.IntVar(&options.workers, "workers", 1, "Move files into this many category folders at once")
+	flagSet.BoolVar(&options.recursive, "recursive", false, "Also move files out of subdirs, such as unpacked archives (overrides TOML)")
+	flagSet.IntVar(&options.maxDepth, "maxDepth", common.DefaultMaxDepth, "How many levels of subdirs -recursive looks into (overrides TOML)")
+	flagSet.BoolVar(&options.preservePaths, "preservePaths", false, "Keep the subdirs of files moved by -recursive under their category (overrides TOML)")
+	return options
+}
 
-	if int(zerolog.TraceLevel) <= *pNewLogLevel && *pNewLogLevel <= int(zerolog.PanicLevel) {
-		zerolog.SetGlobalLevel(zerolog.Level(*pNewLogLevel))
+// initLogger sets the global log level from the command line and returns the configured logger. If the logger can't
+// be set up there's nowhere to log to, so the error is printed and the process exits.
+func initLogger(options *cliOptions) logging.Zerologger {
+	if int(zerolog.TraceLevel) <= options.logLevel && options.logLevel <= int(zerolog.PanicLevel) {
+		zerolog.SetGlobalLevel(zerolog.Level(options.logLevel))
 	} else {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	}
-	logger := logging.InitZeroLog()
-	logger.Trace().Int("GlobalLogLevel", *pNewLogLevel).Msg("set new log level")
+
+	logOptions, err := getLogOptions(options)
+	if err == nil {
+		var logger logging.Zerologger
+		if logger, err = logging.New(logOptions); err == nil {
+			logger.Trace().Int("GlobalLogLevel", options.logLevel).Msg("set new log level")
+			return logger
+		}
+	}
+	fmt.Fprintln(os.Stderr, "unable to set up logging:", err)
+	os.Exit(1)
+	return logging.Zerologger{}
+}
+
+// getLogOptions combines the log settings from the TOML file with the flags that override them. An invalid TOML file
+// is ignored here, so that loadRules can log why.
+func getLogOptions(options *cliOptions) (logging.Options, error) {
+	logConfig := common.DefaultLogConfig
+	if config, err := common.LoadConfig(options.configPath); err == nil {
+		logConfig = config.Log
+	}
+	rotation := logging.Rotation{
+		MaxSize:  int64(logConfig.MaxSizeMB) << 20,
+		MaxAge:   time.Duration(logConfig.MaxAgeDays) * 24 * time.Hour,
+		Keep:     logConfig.Keep,
+		Compress: logConfig.Compress,
+	}
+
+	options.flagSet.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "logMaxSize":
+			rotation.MaxSize = int64(options.logMaxSize) << 20
+		case "logMaxAge":
+			rotation.MaxAge = options.logMaxAge
+		case "logKeep":
+			rotation.Keep = options.logKeep
+		case "logCompress":
+			rotation.Compress = options.logCompress
+		case "logSink":
+			logConfig.Sink = options.logSink
+		case "logFile":
+			logConfig.Path = options.logFile
+		case "logFormat":
+			logConfig.Format = options.logFormat
+		case "logCaller":
+			logConfig.Caller = options.logCaller
+		}
+	})
+
+	sink, err := logging.ParseSink(logConfig.Sink)
+	if err != nil {
+		return logging.Options{}, err
+	}
+	format, err := logging.ParseFormat(logConfig.Format)
+	if err != nil {
+		return logging.Options{}, err
+	}
+	path := logConfig.Path
+	if path == "" && sink != logging.SinkStderr {
+		stateDir, err := common.GetStateDir()
+		if err != nil {
+			return logging.Options{}, err
+		}
+		path = filepath.Join(stateDir, logging.LogFileName)
+	}
+	return logging.Options{Sink: sink, Path: path, Format: format, Caller: logConfig.Caller, Rotation: rotation}, nil
+}
+
+// signalContext returns a context that's cancelled by SIGINT or SIGTERM, so the file being moved can be finished before
+// the process stops. After the first signal the default behaviour is back, so a second one kills the process at once.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// exitIfInterrupted exits with exitInterrupted if err means a signal cancelled the run. releaseLock is called first, as
+// os.Exit skips deferred calls.
+func exitIfInterrupted(logger logging.Zerologger, err error, releaseLock func()) {
+	if !errors.Is(err, context.Canceled) {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "interrupted")
+	logger.Warn().Msg("INTERRUPTED.")
+	releaseLock()
+	os.Exit(exitInterrupted)
+}
+
+// getWorkingSrcDir returns the fully-qualified path of the dir to organise.
+func getWorkingSrcDir(logger logging.Zerologger, options *cliOptions) string {
+	if options.downloadDir != defaultSrcDir {
+		logger.Debug().Str("downloadDir", options.downloadDir).Msg("changed source dir")
+		return options.downloadDir // use command line value
+	}
+
+	workingSrcDir, err := common.GetCurrentUserDownloadPath(defaultSrcDir)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("unable to determine downloads directory")
+	}
+	return workingSrcDir
+}
+
+// acquireLock makes sure this is the only instance that moves files, waiting for another one to finish if asked to. If
+// the lock can't be had, the process exits with exitLocked. The returned function releases the lock.
+func acquireLock(logger logging.Zerologger, options *cliOptions) func() {
+	return lockOrExit(logger, lock.FileName, options.lockWait)
+}
+
+// acquireSessionLock makes sure this is the only daemon or watch session, as they share the retry queue, waiting for
+// another one to stop if asked to. Files are only moved under the lock acquireLock takes, one pass at a time. If the
+// session lock can't be had, the process exits with exitLocked. The returned function releases the lock.
+func acquireSessionLock(logger logging.Zerologger, options *cliOptions) func() {
+	return lockOrExit(logger, lock.SessionFileName, options.lockWait)
+}
+
+// lockOrExit takes the lock named fileName in the state dir, waiting up to wait for another instance to release it,
+// and exits with exitLocked if it can't. The returned function releases the lock.
+func lockOrExit(logger logging.Zerologger, fileName string, wait time.Duration) func() {
+	stateDir, err := common.GetStateDir()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("unable to find state dir")
+	}
+	instanceLock, err := lock.Acquire(filepath.Join(stateDir, fileName), wait)
+	if errors.Is(err, lock.ErrLocked) {
+		fmt.Println(err)
+		logger.Warn().Err(err).Msg("not running: another instance is running")
+		os.Exit(exitLocked)
+	}
+	if err != nil {
+		logger.Fatal().Err(err).Msg("unable to lock state dir")
+	}
+	return releaseFunc(logger, instanceLock)
+}
+
+// releaseFunc returns a function that releases instanceLock, logging any error.
+func releaseFunc(logger logging.Zerologger, instanceLock *lock.Lock) func() {
+	return func() {
+		if err := instanceLock.Release(); err != nil {
+			logger.Err(err).Msg("unable to release lock")
+		}
+	}
+}
+
+// newOrganiser reads the TOML file named on the command line, if any, and returns an Organiser for sourceDir.
+func newOrganiser(logger logging.Zerologger, options *cliOptions, sourceDir string) *organiser.Organiser {
+	config, err := organiser.LoadConfig(options.configPath)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("unable to load excluded extensions")
+	}
+	if options.dedupe != "" {
+		config.Dedupe = options.dedupe
+	}
+	options.flagSet.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "recursive":
+			config.Recursive = options.recursive
+		case "maxDepth":
+			config.MaxDepth = options.maxDepth
+		case "preservePaths":
+			config.PreservePaths = options.preservePaths
+		}
+	})
+	journalPath, err := getJournalPath()
+	if err != nil {
+		logger.Err(err).Msg("unable to find journal; moves can't be undone")
+	}
+
+	downloads, err := organiser.New(organiser.Options{
+		SourceDir:    sourceDir,
+		Config:       config,
+		Logger:       logger.Logger,
+		JournalPath:  journalPath,
+		JournalRunID: options.runID,
+		Workers:      options.workers,
+	})
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid configuration")
+	}
+	return downloads
+}
+
+// runOrganise is the default command: it moves every file in the downloads dir into its subdir.
+func runOrganise(args []string) {
+	startTime := time.Now()
+
+	flagSet := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	options := addCommonFlags(flagSet)
+	pGenerateSample := flagSet.String("generateSampleTomlFile", "", "Generate a sample TOML file at the specified path and exit")
+	pDryRun := flagSet.Bool("dry-run", false, "Print what would be moved without changing anything")
+	pFormat := flagSet.String("format", "text", "Output format for -dry-run: text or json")
+	flagSet.Parse(args) // read command line flags
+
+	logger := initLogger(options)
 
 	if *pGenerateSample != "" {
 		if err := common.GenerateSampleToml(*pGenerateSample); err != nil {
@@ -46,40 +321,44 @@ func main() {
 		return
 	}
 
-	if *pDownloadDir != defaultSrcDir {
-		logger.Debug().Str("downloadDir", *pDownloadDir).Msg("changed source dir")
-		workingSrcDir = *pDownloadDir // use command line value
-	} else {
-		var err error
-		workingSrcDir, err = common.GetCurrentUserDownloadPath(defaultSrcDir)
-		if err != nil {
-			logger.Fatal().Err(err).Msg("unable to determine downloads directory")
-		}
+	workingSrcDir := getWorkingSrcDir(logger, options)
+	releaseLock := func() {}
+	if !*pDryRun {
+		releaseLock = acquireLock(logger, options)
 	}
+	defer releaseLock()
 
 	logger.Info().Msg("START.")
-	files, err := os.ReadDir(workingSrcDir) // get all files
+	downloads := newOrganiser(logger, options, workingSrcDir)
+	ctx, stop := signalContext()
+	defer stop()
 
-	if err != nil {
-		logger.Fatal().Err(err).Msg(err.Error())
+	if *pDryRun {
+		if *pFormat != "text" && *pFormat != "json" {
+			fmt.Printf("unknown format %q: use text or json\n", *pFormat)
+			logger.Fatal().Str("format", *pFormat).Msg("unknown format")
+		}
+		plannedMoves, err := downloads.DryRun(ctx)
+		exitIfInterrupted(logger, err, releaseLock)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("unable to plan moves")
+		}
+		if err := organiser.WritePlannedMoves(os.Stdout, plannedMoves, *pFormat == "json"); err != nil {
+			logger.Fatal().Err(err).Msg("unable to print planned moves")
+		}
+		logger.Info().Int("count", len(plannedMoves)).Dur("elapsedTime", time.Since(startTime)).Msg("DRY RUN DONE.")
+		return
 	}
 
-	filesChannel := make(chan string, 4)
-	excluded, err := common.LoadExcludedExtensions(*pExcludedExtensions)
+	report, err := downloads.Organise(ctx, nil)
+	exitIfInterrupted(logger, err, releaseLock)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("unable to load excluded extensions")
-	}
-	filesToMove := org.GetFilesToMove(files, excluded)
-
-	if len(filesToMove) > 0 {
-		logger.Debug().Str("filesToMove", fmt.Sprintf("%v", filesToMove))
-		go org.MoveFiles(workingSrcDir, filesToMove, filesChannel)
-		for fileMoved := range filesChannel {
-			logger.Info().Str("filePath", fileMoved).Msg("new location")
-		}
-	} else {
-		logger.Info().Msg("No files to move.")
+		logger.Fatal().Err(err).Msg("unable to move files")
 	}
 
 	logger.Info().Dur("elapsedTime", time.Since(startTime)).Msg("DONE.")
+	if report.Count(organiser.ActionFailed) > 0 {
+		releaseLock() // os.Exit skips deferred calls
+		os.Exit(exitFailed)
+	}
 }
@@ -0,0 +1,489 @@
+// Package organiser organises a downloads dir the way the organise-downloads command does, for programs that want to
+// do it themselves. Nothing in it exits the process: every failure is returned, or reported in a MoveResult.
+//
+// An Organiser first makes a Plan, which can be saved and reviewed, and then applies it:
+//
+//	downloads, err := organiser.New(organiser.Options{SourceDir: dir, Config: config})
+//	if err != nil {
+//		return err
+//	}
+//	movePlan, err := downloads.Plan(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	report, err := downloads.Apply(ctx, movePlan)
+package organiser
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/RMBeristain/organise-downloads/internal/common"
+	"github.com/RMBeristain/organise-downloads/internal/dedupe"
+	"github.com/RMBeristain/organise-downloads/internal/journal"
+	"github.com/RMBeristain/organise-downloads/internal/org"
+	"github.com/RMBeristain/organise-downloads/internal/plan"
+	"github.com/rs/zerolog"
+)
+
+type (
+	Config         = common.Config    // the settings read from the TOML file
+	Action         = org.Action       // what became of a file Apply was given
+	MoveResult     = org.MoveResult   // what Apply did with one file
+	MoveStats      = org.MoveStats    // how the destinations were checked
+	Deferred       = org.Deferred     // a file that may still be being written, left for a later run
+	PlannedMove    = org.PlannedMove  // what Apply would do with one file, as reported by DryRun
+	ChangedFile    = plan.ChangedFile // a file that changed since its plan was made, and so isn't moved
+	DuplicateGroup = dedupe.Group     // a set of identical files
+	DedupeResult   = dedupe.Result    // what happened to one duplicate
+)
+
+const (
+	ActionMoved    = org.ActionMoved
+	ActionRemoved  = org.ActionRemoved
+	ActionSkipped  = org.ActionSkipped
+	ActionDeferred = org.ActionDeferred
+	ActionFailed   = org.ActionFailed
+)
+
+// ErrInUse is the Err of a deferred MoveResult for a file that another process is using.
+var ErrInUse = org.ErrInUse
+
+// Lister lists the source dir, which decides the files that are considered for moving. That's all it controls: the
+// files themselves are always read, checked, moved and journalled through the os package, as moves rely on rename
+// semantics that only a real filesystem has. So a Lister must only return entries that really are in the source dir.
+type Lister interface {
+	ReadDir(name string) ([]fs.DirEntry, error)
+}
+
+// DirLister is a Lister that can also list a dir a chunk at a time, which lets Organise start moving files before a
+// large dir has been listed.
+type DirLister interface {
+	Lister
+	OpenDir(name string) (DirReader, error)
+}
+
+// DirReader reads the entries of a dir a few at a time, and returns io.EOF after the last one, as *os.File does.
+type DirReader interface {
+	ReadDir(n int) ([]fs.DirEntry, error)
+	Close() error
+}
+
+// scanChunkSize is how many entries Organise reads from a DirReader at once.
+const scanChunkSize = 1024
+
+// OSLister lists dirs through the operating system.
+type OSLister struct{}
+
+// ReadDir calls os.ReadDir.
+func (OSLister) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+// OpenDir calls os.Open.
+func (OSLister) OpenDir(name string) (DirReader, error) {
+	dir, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return dir, nil
+}
+
+// Options configures an Organiser. Only SourceDir is required.
+type Options struct {
+	SourceDir          string         // the dir to organise
+	Config             Config         // the rules; LoadConfig reads them from a TOML file
+	ExcludedExtensions []string       // extensions or names that aren't moved, on top of Config.ExcludedFiles
+	OnConflict         string         // if set, overrides Config.OnConflict
+	Logger             zerolog.Logger // the zero value logs nothing
+	Lister             Lister         // lists SourceDir; nil means OSLister
+	JournalPath        string         // if set, moves are recorded there so they can be undone
+	JournalRunID       string         // if set, all moves are recorded under this run, to be undone together
+	Workers            int            // how many subdirs Apply fills at once; less than 1 means 1
+}
+
+// Organiser plans and applies the moves that organise one dir.
+type Organiser struct {
+	options Options
+	rules   org.Rules
+}
+
+// Plan is the moves Apply will carry out, with what was found while planning them. Only the embedded plan.Plan is
+// saved by Write and Encode, so a plan that's read back has no Deferred files or Duplicates.
+type Plan struct {
+	plan.Plan
+	Deferred   []Deferred       `json:"-"` // files that may still be being written; they're left for a later run
+	Duplicates []DuplicateGroup `json:"-"` // identical files; only the kept copies are moved, and Apply dedupes the rest
+}
+
+// Report is what Apply or Organise did.
+type Report struct {
+	RunID    string         // the journal run that recorded the moves; empty if they weren't recorded
+	Results  []MoveResult   // one for every file that still matched the plan; Organise doesn't keep them
+	Changed  []ChangedFile  // files that changed since the plan was made
+	Deferred []Deferred     // files that may still be being written; they're left for a later run
+	Deduped  []DedupeResult // what happened to each duplicate, if the dedupe action changes files
+	Stats    MoveStats      // how many destination checks were made in memory rather than on disk
+	counts   map[Action]int
+}
+
+// Count returns how many files had action.
+func (report Report) Count(action Action) int {
+	return report.counts[action]
+}
+
+// add logs result and counts it, and keeps it in Results if keep is set.
+func (report *Report) add(logger zerolog.Logger, result MoveResult, keep bool) {
+	logResult(logger, result)
+	if report.counts == nil {
+		report.counts = make(map[Action]int)
+	}
+	report.counts[result.Action]++
+	if keep {
+		report.Results = append(report.Results, result)
+	}
+}
+
+// LoadConfig reads the TOML file at path, or returns the default settings if path is empty.
+func LoadConfig(path string) (Config, error) {
+	return common.LoadConfig(path)
+}
+
+// ReadPlan loads a plan saved by Plan.Write.
+func ReadPlan(path string) (Plan, error) {
+	movePlan, err := plan.Read(path)
+	if err != nil {
+		return Plan{}, err
+	}
+	return Plan{Plan: movePlan}, nil
+}
+
+// WritePlannedMoves prints the result of DryRun to w, either as one line per file or as a JSON array.
+func WritePlannedMoves(w io.Writer, plannedMoves []PlannedMove, asJSON bool) error {
+	return org.WritePlannedMoves(w, plannedMoves, asJSON)
+}
+
+// New checks options and returns an Organiser for options.SourceDir.
+func New(options Options) (*Organiser, error) {
+	if options.SourceDir == "" {
+		return nil, fmt.Errorf("no source dir")
+	}
+	if options.Lister == nil {
+		options.Lister = OSLister{}
+	}
+
+	config := options.Config
+	config.ExcludedFiles = append(append([]string(nil), config.ExcludedFiles...), options.ExcludedExtensions...)
+	if options.OnConflict != "" {
+		config.OnConflict = options.OnConflict
+	}
+	rules, err := org.NewRules(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	rules.Logger = options.Logger
+	return &Organiser{options: options, rules: rules}, nil
+}
+
+// Plan works out where every file in the source dir should go.
+func (organiser *Organiser) Plan(ctx context.Context) (Plan, error) {
+	files, err := organiser.options.Lister.ReadDir(organiser.options.SourceDir)
+	if err != nil {
+		return Plan{}, err
+	}
+	return organiser.PlanFiles(ctx, files)
+}
+
+// PlanFiles works out where files, which must be entries of the source dir, should go. Duplicates are only looked for
+// among them.
+func (organiser *Organiser) PlanFiles(ctx context.Context, files []fs.DirEntry) (Plan, error) {
+	if err := ctx.Err(); err != nil {
+		return Plan{}, err
+	}
+	logger := organiser.options.Logger
+	sourceDir := organiser.options.SourceDir
+
+	rules, groups, err := organiser.findDuplicates(ctx, files)
+	if err != nil {
+		return Plan{}, err
+	}
+	targets, deferred, err := org.GetFilesToMove(ctx, sourceDir, files, rules)
+	if err != nil {
+		return Plan{}, err
+	}
+	logDeferred(logger, deferred)
+	movePlan, err := plan.New(sourceDir, targets)
+	if err != nil {
+		return Plan{}, err
+	}
+	return Plan{Plan: movePlan, Deferred: deferred, Duplicates: groups}, nil
+}
+
+// Entries returns the entry of fileName, in the source dir, and of its in-progress download if there's one, ready for
+// PlanFiles.
+func (organiser *Organiser) Entries(fileName string) ([]fs.DirEntry, error) {
+	return org.EntriesFor(organiser.options.SourceDir, fileName, organiser.rules)
+}
+
+// DryRun reports what Plan and Apply would do with every file in the source dir, without changing anything.
+func (organiser *Organiser) DryRun(ctx context.Context) ([]PlannedMove, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	files, err := organiser.options.Lister.ReadDir(organiser.options.SourceDir)
+	if err != nil {
+		return nil, err
+	}
+	rules, _, err := organiser.findDuplicates(ctx, files)
+	if err != nil {
+		return nil, err
+	}
+	return org.DryRun(ctx, organiser.options.SourceDir, files, rules)
+}
+
+// findDuplicates looks for identical files among files, if the rules ask for it, and returns rules that skip them.
+// Files that can't be read are only logged; the error is ctx's, if it's done before every file is hashed.
+func (organiser *Organiser) findDuplicates(
+	ctx context.Context, files []fs.DirEntry,
+) (org.Rules, []DuplicateGroup, error) {
+	rules := organiser.rules
+	if rules.Dedupe == dedupe.ActionOff {
+		return rules, nil, nil
+	}
+
+	logger := organiser.options.Logger
+	sourceDir := organiser.options.SourceDir
+	groups, err := org.FindDuplicates(ctx, sourceDir, files, rules, runtime.NumCPU())
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return rules, nil, ctxErr
+	}
+	if err != nil {
+		logger.Warn().Err(err).Msg("some files couldn't be checked for duplicates")
+	}
+	for _, group := range groups {
+		logger.Info().Str("keep", group.Keep).Strs("duplicates", group.Duplicates).Int64("size", group.Size).
+			Msg("found duplicates")
+	}
+	rules.Duplicates = dedupe.DuplicatesIn(groups, sourceDir)
+	return rules, groups, nil
+}
+
+// Apply carries out movePlan, which must be for the source dir. Files that changed since the plan was made are left
+// where they are, and the duplicates it found are deduped first if the dedupe action is trash or hardlink. Files that
+// fail to move are reported in Report.Results; the error is set if nothing could be done.
+//
+// Results for files bound for the same subdir are in plan order, but with more than one worker those for different
+// subdirs may be interleaved.
+//
+// If ctx is done part way through, each file being moved is finished, or rolled back if it was being copied, and no
+// more are started. Apply then returns what was done so far, with ctx's error.
+func (organiser *Organiser) Apply(ctx context.Context, movePlan Plan) (Report, error) {
+	if err := ctx.Err(); err != nil {
+		return Report{}, err
+	}
+	logger := organiser.options.Logger
+	sourceDir := organiser.options.SourceDir
+	if filepath.Clean(movePlan.SourceDir) != filepath.Clean(sourceDir) {
+		return Report{}, fmt.Errorf("plan is for %s, not %s", movePlan.SourceDir, sourceDir)
+	}
+
+	unchanged, changed, err := movePlan.Verify()
+	if err != nil {
+		return Report{}, fmt.Errorf("unable to verify plan: %w", err)
+	}
+	report := Report{Changed: changed, Deferred: movePlan.Deferred}
+	for _, this := range changed {
+		logger.Warn().Str("file", this.File).Str("reason", this.Reason).Msg("refusing to move changed file")
+	}
+
+	trashDir := filepath.Join(sourceDir, dedupe.TrashDirName)
+	report.Deduped = dedupe.Apply(ctx, movePlan.Duplicates, organiser.rules.Dedupe, trashDir)
+	for _, result := range report.Deduped {
+		if result.Err != nil {
+			logger.Err(result.Err).Str("path", result.Path).Msg("unable to dedupe file")
+		} else {
+			logger.Info().Str("path", result.Path).Str("keep", result.Keep).Str("action", string(organiser.rules.Dedupe)).
+				Msg("deduped")
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+
+	if len(unchanged) == 0 {
+		logger.Info().Msg("No files to move.")
+		return report, nil
+	}
+
+	moveOptions, closeJournal := organiser.moveOptions(&report)
+	defer closeJournal()
+
+	results := make(chan MoveResult, 4*max(organiser.options.Workers, 1))
+	logger.Debug().Str("filesToMove", fmt.Sprintf("%v", unchanged)).Send()
+	go org.MoveFiles(ctx, sourceDir, unchanged, results, moveOptions)
+	for result := range results {
+		report.add(logger, result, true)
+	}
+	logSummary(logger, report)
+	return report, ctx.Err()
+}
+
+// Organise moves every file in the source dir into its subdir, without a plan to review first. The dir is listed a
+// chunk at a time, and the files in each chunk are classified and moved while the next ones are read, so moves start
+// straight away and memory doesn't grow with the size of the dir. For the same reason every MoveResult is passed to
+// onResult, if it's set, and not kept in Report.Results.
+//
+// Looking for duplicates needs the whole listing, so if the dedupe action isn't off, or the Lister isn't a DirLister, Organise
+// makes a Plan and applies it instead.
+//
+// If ctx is done part way through, Organise stops the way Apply does. If listing the dir fails part way through, the
+// files already listed are still moved, and the error is returned with the Report.
+func (organiser *Organiser) Organise(ctx context.Context, onResult func(MoveResult)) (Report, error) {
+	if err := ctx.Err(); err != nil {
+		return Report{}, err
+	}
+	dirLister, ok := organiser.options.Lister.(DirLister)
+	if !ok || organiser.rules.Dedupe != dedupe.ActionOff {
+		return organiser.planAndApply(ctx, onResult)
+	}
+	logger := organiser.options.Logger
+	sourceDir := organiser.options.SourceDir
+	dir, err := dirLister.OpenDir(sourceDir)
+	if err != nil {
+		return Report{}, err
+	}
+	defer dir.Close()
+
+	var report Report
+	moveOptions, closeJournal := organiser.moveOptions(&report)
+	defer closeJournal()
+
+	chunks := make(chan []fs.DirEntry, 1)
+	targets := make(chan map[string][]string, 1)
+	results := make(chan MoveResult, 4*max(organiser.options.Workers, 1))
+	var scanErr error
+	var deferred []Deferred
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		scanErr = org.ScanChunks(ctx, dir, scanChunkSize, chunks)
+	}()
+	go func() {
+		defer wg.Done()
+		deferred, _ = org.ClassifyStream(ctx, sourceDir, chunks, targets, organiser.rules) // only fails if ctx is done
+	}()
+	go org.MoveStream(ctx, sourceDir, targets, results, moveOptions)
+	for result := range results {
+		report.add(logger, result, false)
+		if onResult != nil {
+			onResult(result)
+		}
+	}
+	wg.Wait()
+
+	report.Deferred = deferred
+	logDeferred(logger, deferred)
+	logSummary(logger, report)
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+	if scanErr != nil {
+		return report, fmt.Errorf("unable to list %s: %w", sourceDir, scanErr)
+	}
+	return report, nil
+}
+
+// OrganiseExcept is Organise, but it leaves alone the files skip returns true for, as if they weren't there. skip is
+// called with the name of every file that could be moved, relative to the source dir.
+func (organiser *Organiser) OrganiseExcept(
+	ctx context.Context, skip func(fileName string) bool, onResult func(MoveResult),
+) (Report, error) {
+	this := *organiser
+	this.rules.Skip = skip
+	return this.Organise(ctx, onResult)
+}
+
+// planAndApply is Organise for when the whole listing is needed up front.
+func (organiser *Organiser) planAndApply(ctx context.Context, onResult func(MoveResult)) (Report, error) {
+	movePlan, err := organiser.Plan(ctx)
+	if err != nil {
+		return Report{}, err
+	}
+	report, err := organiser.Apply(ctx, movePlan)
+	if onResult != nil {
+		for _, result := range report.Results {
+			onResult(result)
+		}
+	}
+	report.Results = nil
+	return report, err
+}
+
+// moveOptions returns the options MoveFiles needs to carry out the rules, with the journal open if there's one, and
+// a function that closes it. The journal run, and how the destinations were checked, are recorded in report.
+func (organiser *Organiser) moveOptions(report *Report) (org.MoveOptions, func()) {
+	logger := organiser.options.Logger
+	moveOptions := org.MoveOptions{
+		OnConflict:     organiser.rules.OnConflict,
+		VerifyCopyHash: organiser.rules.VerifyCopyHash,
+		Workers:        organiser.options.Workers,
+		PreservePaths:  organiser.rules.PreservePaths,
+		Stats:          &report.Stats,
+		Logger:         logger,
+	}
+	if organiser.options.JournalPath == "" {
+		return moveOptions, func() {}
+	}
+	var moveJournal *journal.Journal
+	var err error
+	if organiser.options.JournalRunID != "" {
+		moveJournal, err = journal.OpenRun(organiser.options.JournalPath, organiser.options.JournalRunID)
+	} else {
+		moveJournal, err = journal.Open(organiser.options.JournalPath)
+	}
+	if err != nil {
+		logger.Err(err).Msg("unable to open journal; this run can't be undone")
+		return moveOptions, func() {}
+	}
+	logger.Info().Str("runID", moveJournal.RunID()).Msg("recording moves in journal")
+	moveOptions.Journal = moveJournal
+	report.RunID = moveJournal.RunID()
+	return moveOptions, func() { moveJournal.Close() }
+}
+
+// logDeferred logs the files that were left for a later run.
+func logDeferred(logger zerolog.Logger, deferred []Deferred) {
+	for _, this := range deferred {
+		logger.Info().Str("file", this.File).Str("reason", this.Reason).Msg("deferred: not settled yet")
+	}
+}
+
+// logSummary logs how many files had each action.
+func logSummary(logger zerolog.Logger, report Report) {
+	logger.Info().Int("moved", report.Count(ActionMoved)).Int("removed", report.Count(ActionRemoved)).
+		Int("skipped", report.Count(ActionSkipped)).Int("deferred", report.Count(ActionDeferred)).
+		Int("failed", report.Count(ActionFailed)).Msg("summary")
+}
+
+// logResult logs what became of a single file.
+func logResult(logger zerolog.Logger, result MoveResult) {
+	switch result.Action {
+	case ActionMoved:
+		logger.Info().Str("filePath", result.Destination).Str("outcome", result.Reason).Int64("bytes", result.Bytes).
+			Dur("duration", result.Duration).Msg("new location")
+	case ActionRemoved:
+		logger.Info().Str("filePath", result.Source).Str("identicalTo", result.Destination).Msg("removed duplicate")
+	case ActionFailed:
+		logger.Err(result.Err).Str("filePath", result.Source).Str("reason", result.Reason).Msg("not moved")
+	default:
+		logger.Info().AnErr("error", result.Err).Str("filePath", result.Source).Str("action", string(result.Action)).
+			Str("reason", result.Reason).Msg("not moved")
+	}
+}
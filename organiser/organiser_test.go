@@ -0,0 +1,390 @@
+package organiser
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+// setupDir writes the given files to a temp dir and returns its path.
+func setupDir(t *testing.T, files ...string) string {
+	t.Helper()
+	sourceDir := t.TempDir()
+	for _, name := range files {
+		if err := os.WriteFile(filepath.Join(sourceDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sourceDir
+}
+
+// onlyLister lists just the named entries of a dir, to check that Plan goes through Options.Lister.
+type onlyLister []string
+
+func (names onlyLister) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	for _, fileName := range names {
+		info, err := os.Lstat(filepath.Join(name, fileName))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"no source dir", Options{}},
+		{"unknown conflict policy", Options{SourceDir: t.TempDir(), OnConflict: "bogus"}},
+		{"negative min age", Options{SourceDir: t.TempDir(), Config: Config{MinAge: -1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.options); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+
+	t.Run("Excluded extensions are added to a copy", func(t *testing.T) {
+		config := Config{ExcludedFiles: make([]string, 1, 4)}
+		config.ExcludedFiles[0] = ".DS_Store"
+		if _, err := New(Options{SourceDir: t.TempDir(), Config: config, ExcludedExtensions: []string{".tmp"}}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if extended := config.ExcludedFiles[:2]; extended[1] != "" {
+			t.Errorf("expected the caller's slice to be left alone, got %v", extended)
+		}
+	})
+}
+
+func TestPlanAndApply(t *testing.T) {
+	sourceDir := setupDir(t, "a.txt", "b.pdf", "c.tmp")
+	journalPath := filepath.Join(t.TempDir(), "journal.jsonl")
+	downloads, err := New(Options{SourceDir: sourceDir, ExcludedExtensions: []string{".tmp"}, JournalPath: journalPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movePlan, err := downloads.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(movePlan.Files) != 2 || len(movePlan.Targets["txt_files"]) != 1 || len(movePlan.Targets["pdf_files"]) != 1 {
+		t.Fatalf("expected a.txt and b.pdf to be planned, got %+v", movePlan.Targets)
+	}
+
+	report, err := downloads.Apply(context.Background(), movePlan)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.Count(ActionMoved) != 2 || len(report.Results) != 2 {
+		t.Errorf("expected 2 files to be moved, got %+v", report.Results)
+	}
+	if report.RunID == "" {
+		t.Error("expected the moves to be recorded in the journal")
+	}
+	for _, path := range []string{"txt_files/a.txt", "pdf_files/b.pdf", "c.tmp"} {
+		if _, err := os.Stat(filepath.Join(sourceDir, path)); err != nil {
+			t.Errorf("expected %s, got %v", path, err)
+		}
+	}
+}
+
+func TestApply_JournalRunID(t *testing.T) {
+	sourceDir := setupDir(t, "a.txt", "b.pdf")
+	journalPath := filepath.Join(t.TempDir(), "journal.jsonl")
+	downloads, err := New(Options{SourceDir: sourceDir, JournalPath: journalPath, JournalRunID: "session"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each file is applied on its own, as watch mode does, but both moves belong to the same run.
+	for _, name := range []string{"a.txt", "b.pdf"} {
+		files, err := downloads.Entries(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		movePlan, err := downloads.PlanFiles(context.Background(), files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := downloads.Apply(context.Background(), movePlan)
+		if err != nil || report.RunID != "session" {
+			t.Errorf("expected %s to be recorded in the session's run, got %q (%v)", name, report.RunID, err)
+		}
+	}
+}
+
+func TestPlan_Lister(t *testing.T) {
+	sourceDir := setupDir(t, "a.txt", "b.txt")
+	downloads, err := New(Options{SourceDir: sourceDir, Lister: onlyLister{"b.txt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movePlan, err := downloads.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if files := movePlan.Targets["txt_files"]; len(files) != 1 || files[0] != "b.txt" {
+		t.Errorf("expected only b.txt to be planned, got %v", files)
+	}
+}
+
+func TestApply_Refused(t *testing.T) {
+	sourceDir := setupDir(t, "a.txt", "b.txt")
+	downloads, err := New(Options{SourceDir: sourceDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	movePlan, err := downloads.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Changed file", func(t *testing.T) {
+		later := time.Now().Add(time.Hour)
+		if err := os.Chtimes(filepath.Join(sourceDir, "a.txt"), later, later); err != nil {
+			t.Fatal(err)
+		}
+		report, err := downloads.Apply(context.Background(), movePlan)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(report.Changed) != 1 || report.Changed[0].File != "a.txt" {
+			t.Errorf("expected a.txt to be refused, got %+v", report.Changed)
+		}
+		if report.Count(ActionMoved) != 1 {
+			t.Errorf("expected b.txt to be moved, got %+v", report.Results)
+		}
+	})
+
+	t.Run("Other source dir", func(t *testing.T) {
+		other, err := New(Options{SourceDir: t.TempDir()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.Apply(context.Background(), movePlan); err == nil {
+			t.Error("expected error for a plan made for another dir, got nil")
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := downloads.Apply(ctx, movePlan); err == nil {
+			t.Error("expected error for a cancelled context, got nil")
+		}
+		if _, err := os.Stat(filepath.Join(sourceDir, "a.txt")); err != nil {
+			t.Errorf("expected a.txt to be left alone, got %v", err)
+		}
+	})
+}
+
+func TestOrganise(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"Streamed", Options{}},
+		{"Streamed by several workers", Options{Workers: 3}},
+		{"Planned, for a Lister that can't stream", Options{Lister: onlyLister{"a.txt", "b.pdf", "c.tmp"}}},
+		{"Planned, to look for duplicates", Options{Config: Config{Dedupe: "report"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.options.SourceDir = setupDir(t, "a.txt", "b.pdf", "c.tmp")
+			tt.options.ExcludedExtensions = []string{".tmp"}
+			downloads, err := New(tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var results []MoveResult
+			report, err := downloads.Organise(context.Background(), func(result MoveResult) {
+				results = append(results, result)
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(results) != 2 || report.Count(ActionMoved) != 2 {
+				t.Errorf("expected 2 files to be moved, got %+v", results)
+			}
+			if report.Results != nil {
+				t.Errorf("expected results not to be kept, got %+v", report.Results)
+			}
+			for _, path := range []string{"txt_files/a.txt", "pdf_files/b.pdf", "c.tmp"} {
+				if _, err := os.Stat(filepath.Join(tt.options.SourceDir, path)); err != nil {
+					t.Errorf("expected %s, got %v", path, err)
+				}
+			}
+		})
+	}
+
+	t.Run("Cancelled", func(t *testing.T) {
+		sourceDir := setupDir(t, "a.txt")
+		downloads, err := New(Options{SourceDir: sourceDir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := downloads.Organise(ctx, nil); err == nil {
+			t.Error("expected error for a cancelled context, got nil")
+		}
+	})
+}
+
+func TestOrganiseExcept(t *testing.T) {
+	sourceDir := setupDir(t, "a.txt", "b.pdf", "c.zip")
+	young := time.Now()
+	older := young.Add(-time.Hour)
+	for _, name := range []string{"a.txt", "b.pdf"} {
+		if err := os.Chtimes(filepath.Join(sourceDir, name), older, older); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(sourceDir, "c.zip"), young, young); err != nil {
+		t.Fatal(err)
+	}
+	downloads, err := New(Options{SourceDir: sourceDir, Config: Config{MinAge: 60}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var skipped []string
+	report, err := downloads.OrganiseExcept(context.Background(), func(fileName string) bool {
+		skipped = append(skipped, fileName)
+		return fileName == "b.pdf"
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sort.Strings(skipped)
+	if len(skipped) != 3 || report.Count(ActionMoved) != 1 {
+		t.Errorf("expected every file to be offered to skip and only a.txt to be moved, got %v and %d moved", skipped,
+			report.Count(ActionMoved))
+	}
+	if _, err := os.Stat(filepath.Join(sourceDir, "b.pdf")); err != nil {
+		t.Errorf("expected b.pdf to be left alone, got %v", err)
+	}
+	if len(report.Deferred) != 1 || report.Deferred[0].File != "c.zip" || report.Deferred[0].SettlesAt.IsZero() {
+		t.Errorf("expected c.zip to be reported as deferred until it settles, got %+v", report.Deferred)
+	}
+}
+
+// benchmarkFileCount is how many files the benchmarks organise, enough for the listing itself to take a while.
+const benchmarkFileCount = 100_000
+
+// setupBenchmarkDir fills a temp dir with benchmarkFileCount empty files of a few types.
+func setupBenchmarkDir(b *testing.B) string {
+	b.Helper()
+	sourceDir := b.TempDir()
+	extensions := []string{"txt", "pdf", "jpg", "zip", "iso", "mp4", "csv", "epub"}
+	for i := range benchmarkFileCount {
+		name := fmt.Sprintf("file-%06d.%s", i, extensions[i%len(extensions)])
+		if err := os.WriteFile(filepath.Join(sourceDir, name), nil, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return sourceDir
+}
+
+// trackPeakHeap samples the heap in use until the returned function is called, which returns the most it saw.
+func trackPeakHeap() (stop func() uint64) {
+	done := make(chan struct{})
+	peak := make(chan uint64)
+	go func() {
+		var stats runtime.MemStats
+		var maxHeapInUse uint64
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&stats)
+			maxHeapInUse = max(maxHeapInUse, stats.HeapInuse)
+			select {
+			case <-done:
+				peak <- maxHeapInUse
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		return <-peak
+	}
+}
+
+// BenchmarkOrganise compares moving a large dir through a Plan with streaming it. Besides the time per run it reports
+// how long it took for the first file to be moved and the most heap in use, which is what streaming improves. Run it
+// with: go test ./organiser -run '^$' -bench Organise -benchtime 3x
+func BenchmarkOrganise(b *testing.B) {
+	runs := []struct {
+		name     string
+		organise func(ctx context.Context, downloads *Organiser, startTime time.Time) (firstMove time.Duration, err error)
+	}{
+		{
+			name: "Plan and Apply",
+			organise: func(ctx context.Context, downloads *Organiser, startTime time.Time) (time.Duration, error) {
+				movePlan, err := downloads.Plan(ctx)
+				if err != nil {
+					return 0, err
+				}
+				firstMove := time.Since(startTime) // no file is moved before the plan is made
+				_, err = downloads.Apply(ctx, movePlan)
+				return firstMove, err
+			},
+		},
+		{
+			name: "Organise",
+			organise: func(ctx context.Context, downloads *Organiser, startTime time.Time) (time.Duration, error) {
+				var firstMove time.Duration
+				_, err := downloads.Organise(ctx, func(MoveResult) {
+					if firstMove == 0 {
+						firstMove = time.Since(startTime)
+					}
+				})
+				return firstMove, err
+			},
+		},
+	}
+	for _, run := range runs {
+		b.Run(run.name, func(b *testing.B) {
+			var firstMoveTotal time.Duration
+			var peakHeapTotal uint64
+			for range b.N {
+				b.StopTimer()
+				downloads, err := New(Options{SourceDir: setupBenchmarkDir(b)})
+				if err != nil {
+					b.Fatal(err)
+				}
+				runtime.GC()
+				stopTracking := trackPeakHeap()
+				b.StartTimer()
+
+				firstMove, err := run.organise(context.Background(), downloads, time.Now())
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				peakHeapTotal += stopTracking()
+				firstMoveTotal += firstMove
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(firstMoveTotal.Milliseconds())/float64(b.N), "ms-to-first-move")
+			b.ReportMetric(float64(peakHeapTotal)/float64(b.N)/(1<<20), "peak-heap-MB")
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/RMBeristain/organise-downloads/organiser"
+)
+
+// runPlan computes the moves for the downloads dir and saves them as a plan file that 'apply' can run later.
+func runPlan(args []string) {
+	startTime := time.Now()
+
+	flagSet := flag.NewFlagSet("plan", flag.ExitOnError)
+	options := addCommonFlags(flagSet)
+	pOutput := flagSet.String("o", "", "Write the plan to this file instead of stdout")
+	flagSet.Parse(args)
+
+	logger := initLogger(options)
+	workingSrcDir := getWorkingSrcDir(logger, options)
+	downloads := newOrganiser(logger, options, workingSrcDir)
+
+	ctx, stop := signalContext()
+	defer stop()
+	movePlan, err := downloads.Plan(ctx)
+	exitIfInterrupted(logger, err, func() {})
+	if err != nil {
+		fmt.Printf("unable to create plan: %v\n", err)
+		logger.Fatal().Err(err).Msg("unable to create plan")
+	}
+
+	if *pOutput == "" {
+		err = movePlan.Encode(os.Stdout)
+	} else {
+		err = movePlan.Write(*pOutput)
+	}
+	if err != nil {
+		fmt.Printf("unable to write plan: %v\n", err)
+		logger.Fatal().Err(err).Msg("unable to write plan")
+	}
+
+	logger.Info().Str("path", *pOutput).Int("fileCount", len(movePlan.Files)).Dur("elapsedTime", time.Since(startTime)).
+		Msg("PLAN DONE.")
+}
+
+// runApply moves the files listed in a plan file, skipping any that changed since the plan was made.
+func runApply(args []string) {
+	startTime := time.Now()
+
+	flagSet := flag.NewFlagSet("apply", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s apply [flags] <plan.json>\n", os.Args[0])
+		flagSet.PrintDefaults()
+	}
+	options := addCommonFlags(flagSet)
+	flagSet.Parse(args)
+
+	logger := initLogger(options)
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		os.Exit(2)
+	}
+	releaseLock := acquireLock(logger, options)
+	defer releaseLock()
+
+	movePlan, err := organiser.ReadPlan(flagSet.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		logger.Fatal().Err(err).Msg("unable to read plan")
+	}
+	if err := checkPlanSourceDir(options, movePlan.SourceDir); err != nil {
+		fmt.Println(err)
+		logger.Fatal().Err(err).Msg("refusing to apply plan")
+	}
+
+	logger.Info().Str("plan", flagSet.Arg(0)).Str("sourceDir", movePlan.SourceDir).Msg("START.")
+	ctx, stop := signalContext()
+	defer stop()
+	report, err := newOrganiser(logger, options, movePlan.SourceDir).Apply(ctx, movePlan)
+	exitIfInterrupted(logger, err, releaseLock)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("unable to apply plan")
+	}
+	for _, this := range report.Changed {
+		// The user is probably waiting on the command line, so tell them as well as the log.
+		fmt.Printf("refusing to move %s: %s\n", this.File, this.Reason)
+	}
+
+	logger.Info().Int("refusedCount", len(report.Changed)).Dur("elapsedTime", time.Since(startTime)).Msg("DONE.")
+	if report.Count(organiser.ActionFailed) > 0 {
+		releaseLock() // os.Exit skips deferred calls
+		os.Exit(exitFailed)
+	}
+}
+
+// checkPlanSourceDir returns an error if -downloads was given and names another dir than the one the plan was made
+// for. A plan only ever moves files in its own dir, so the flag can't redirect it.
+func checkPlanSourceDir(options *cliOptions, planSourceDir string) error {
+	var given bool
+	options.flagSet.Visit(func(f *flag.Flag) { given = given || f.Name == "downloads" })
+	if !given {
+		return nil
+	}
+	downloadDir, err := filepath.Abs(options.downloadDir)
+	if err != nil {
+		return err
+	}
+	planDir, err := filepath.Abs(planSourceDir)
+	if err != nil {
+		return err
+	}
+	if downloadDir != planDir {
+		return fmt.Errorf("-downloads %s doesn't match the plan, which is for %s", options.downloadDir, planSourceDir)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/RMBeristain/organise-downloads/internal/service"
+)
+
+// runService installs, uninstalls or reports on the systemd or launchd files that run organise-downloads on a schedule.
+func runService(args []string) {
+	flagSet := flag.NewFlagSet("service", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s service install|uninstall|status [flags]\n", os.Args[0])
+		flagSet.PrintDefaults()
+	}
+	options := addCommonFlags(flagSet)
+	pInterval := flagSet.Duration("interval", 20*time.Minute, "Run this often")
+	pTarget := flagSet.String("target", "", "Service manager: systemd or launchd (default: the one for this system)")
+	if len(args) == 0 {
+		flagSet.Usage()
+		os.Exit(2)
+	}
+	action := args[0]
+	flagSet.Parse(args[1:])
+
+	logger := initLogger(options)
+	target, err := service.ParseTarget(*pTarget)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("unable to find home dir")
+	}
+
+	switch action {
+	case "install":
+		executable, err := os.Executable()
+		if err == nil {
+			executable, err = filepath.EvalSymlinks(executable)
+		}
+		if err != nil {
+			logger.Fatal().Err(err).Msg("unable to find the path of this program")
+		}
+		serviceArgs, err := serviceFlags(flagSet)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("unable to resolve paths")
+		}
+
+		files, err := service.Install(target, service.Config{
+			HomeDir:    homeDir,
+			Executable: executable,
+			Args:       serviceArgs,
+			Interval:   *pInterval,
+		})
+		if err != nil {
+			fmt.Printf("unable to install service: %v\n", err)
+			logger.Fatal().Err(err).Msg("unable to install service")
+		}
+		for _, file := range files {
+			fmt.Printf("wrote %s\n", file.Path)
+		}
+		printCommands("To start it, run:", service.InstallCommands(target, homeDir))
+	case "uninstall":
+		removed, err := service.Uninstall(target, homeDir)
+		for _, path := range removed {
+			fmt.Printf("removed %s\n", path)
+		}
+		if err != nil {
+			fmt.Printf("unable to uninstall service: %v\n", err)
+			logger.Fatal().Err(err).Msg("unable to uninstall service")
+		}
+		printCommands("To stop it, run:", service.UninstallCommands(target))
+	case "status":
+		statuses, err := service.Status(target, homeDir)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("unable to check service files")
+		}
+		for _, status := range statuses {
+			if status.Installed {
+				fmt.Printf("installed  %s\n", status.Path)
+			} else {
+				fmt.Printf("missing    %s\n", status.Path)
+			}
+		}
+		printCommands("To see whether it's running, run:", service.StatusCommands(target))
+	default:
+		flagSet.Usage()
+		os.Exit(2)
+	}
+}
+
+// serviceFlags returns the common flags that were set on the command line, so the service runs with the same settings.
+// Paths are made absolute, as the service doesn't run from the current dir.
+func serviceFlags(flagSet *flag.FlagSet) ([]string, error) {
+	var args []string
+	var err error
+	flagSet.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch f.Name {
+		case "downloads", "excludeExtensions", "logFile":
+			if value == "" {
+				break // an empty path keeps its default; filepath.Abs would make it the current dir
+			}
+			if absValue, absErr := filepath.Abs(value); absErr != nil {
+				err = absErr
+			} else {
+				value = absValue
+			}
+		case "loglevel", "dedupe", "wait", "logMaxSize", "logMaxAge", "logKeep", "logCompress", "logSink",
+			"logFormat", "logCaller", "workers", "recursive", "maxDepth", "preservePaths":
+		default:
+			return // service-only flags
+		}
+		args = append(args, "-"+f.Name+"="+value) // the = form also works for bool flags
+	})
+	return args, err
+}
+
+// printCommands prints shell commands the user should run next.
+func printCommands(heading string, commands []string) {
+	fmt.Println(heading)
+	for _, command := range commands {
+		fmt.Printf("  %s\n", command)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/RMBeristain/organise-downloads/internal/common"
+	"github.com/RMBeristain/organise-downloads/internal/journal"
+	"github.com/RMBeristain/organise-downloads/internal/org"
+)
+
+// getJournalPath returns the path of the move journal in the state dir.
+func getJournalPath() (string, error) {
+	stateDir, err := common.GetStateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, journal.FileName), nil
+}
+
+// runUndo moves the files of a previous run back to where they were.
+func runUndo(args []string) {
+	startTime := time.Now()
+
+	flagSet := flag.NewFlagSet("undo", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s undo [-run ID | -last]\n", os.Args[0])
+		flagSet.PrintDefaults()
+	}
+	options := addCommonFlags(flagSet)
+	pRunID := flagSet.String("run", "", "Undo the run with this ID (see the log, or the journal in the state dir)")
+	pLast := flagSet.Bool("last", false, "Undo the most recent run that hasn't been undone yet")
+	flagSet.Parse(args)
+
+	logger := initLogger(options)
+	if (*pRunID == "") == !*pLast {
+		flagSet.Usage()
+		os.Exit(2)
+	}
+	defer acquireLock(logger, options)()
+
+	journalPath, err := getJournalPath()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("unable to find state dir")
+	}
+	entries, err := journal.ReadEntries(journalPath)
+	if err != nil {
+		fmt.Printf("unable to read journal: %v\n", err)
+		logger.Fatal().Err(err).Msg("unable to read journal")
+	}
+
+	runID := *pRunID
+	if *pLast {
+		runID = journal.LastRun(entries)
+		if runID == "" {
+			fmt.Println("nothing to undo")
+			logger.Info().Msg("nothing to undo")
+			return
+		}
+	}
+
+	logger.Info().Str("runID", runID).Msg("START UNDO.")
+	undoJournal, err := journal.OpenRun(journalPath, runID)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("unable to open journal")
+	}
+	defer undoJournal.Close()
+
+	moveBack := func(source, destination string) error {
+		return org.MoveNoReplace(context.Background(), source, destination)
+	}
+	results, err := journal.Undo(undoJournal, entries, runID, moveBack)
+	if err != nil {
+		fmt.Println(err)
+		logger.Fatal().Err(err).Str("runID", runID).Msg("unable to undo run")
+	}
+
+	restoredCount := 0
+	for _, result := range results {
+		if result.Restored {
+			restoredCount++
+			logger.Info().Str("src", result.Entry.Destination).Str("dst", result.Entry.Source).Msg("restored")
+			continue
+		}
+		// The user is waiting on the command line, so tell them as well as the log.
+		fmt.Printf("skipped %s: %s\n", result.Entry.Destination, result.Reason)
+		logger.Warn().Str("file", result.Entry.Destination).Str("reason", result.Reason).Msg("skipped")
+	}
+	fmt.Printf("restored %d of %d file(s) from run %s\n", restoredCount, len(results), runID)
+	logger.Info().Int("restoredCount", restoredCount).Int("totalCount", len(results)).
+		Dur("elapsedTime", time.Since(startTime)).Msg("UNDO DONE.")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/RMBeristain/organise-downloads/internal/journal"
+	"github.com/RMBeristain/organise-downloads/internal/logging"
+	"github.com/RMBeristain/organise-downloads/internal/retry"
+	"github.com/RMBeristain/organise-downloads/internal/watch"
+	"github.com/RMBeristain/organise-downloads/organiser"
+)
+
+// runWatch organises the downloads dir once, then keeps moving files as they arrive until it receives SIGINT or
+// SIGTERM. Every move of the session is recorded under one journal run. Files that can't be moved yet are retried
+// from the daemon's retry queue, as no new event may come for them. As with the daemon, the lock is only held while
+// files are being moved.
+func runWatch(args []string) {
+	flagSet := flag.NewFlagSet("watch", flag.ExitOnError)
+	options := addCommonFlags(flagSet)
+	pDebounce := flagSet.Duration("debounce", 2*time.Second, "Wait this long after a file's last change before moving it")
+	flagSet.Parse(args)
+
+	logger := initLogger(options)
+	workingSrcDir := getWorkingSrcDir(logger, options)
+	options.runID = journal.NewRunID() // so the whole session is undone together
+	downloads := newOrganiser(logger, options, workingSrcDir)
+	defer acquireSessionLock(logger, options)()
+
+	watcher, err := watch.New(workingSrcDir)
+	if err != nil {
+		fmt.Println(err)
+		logger.Fatal().Err(err).Msg("unable to watch downloads dir")
+	}
+	defer watcher.Close()
+
+	ctx, stop := signalContext()
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		watcher.Close() // ends the loop below once the file being moved is done
+	}()
+
+	// Start watching before the first scan, so files that arrive during it aren't missed.
+	queue := loadRetryQueue(logger)
+	logger.Info().Str("downloadDir", workingSrcDir).Dur("debounce", *pDebounce).Int("retryCount", len(queue.Items())).
+		Str("runID", options.runID).Msg("WATCHING.")
+	whileLocked(ctx, logger, func() { runCycle(ctx, logger, workingSrcDir, downloads, queue) })
+	saveRetryQueue(logger, queue)
+
+	events := watch.Debounce(watcher.Events(), *pDebounce)
+watching:
+	for {
+		due, stopTimer := retryTimer(queue)
+		select {
+		case event, ok := <-events:
+			stopTimer()
+			if !ok || ctx.Err() != nil {
+				break watching // stopped, and the events that were still being debounced are dropped
+			}
+			if event.Overflow {
+				logger.Warn().Msg("missed some file events; scanning the whole dir")
+				whileLocked(ctx, logger, func() { runCycle(ctx, logger, workingSrcDir, downloads, queue) })
+			} else {
+				whileLocked(ctx, logger, func() { organiseFile(ctx, logger, downloads, queue, event.Name) })
+			}
+		case <-due:
+			whileLocked(ctx, logger, func() { retryDue(ctx, logger, downloads, queue) })
+		}
+		saveRetryQueue(logger, queue)
+	}
+	watcher.Close() // waits for the watcher to stop, so Err can be read
+	if err := watcher.Err(); err != nil && ctx.Err() == nil {
+		logger.Fatal().Err(err).Msg("stopped watching downloads dir")
+	}
+	logger.Info().Msg("STOPPED WATCHING.")
+}
+
+// retryTimer returns a channel that receives when the next retry in queue is due, and a function that stops it. If the
+// queue is empty the channel is nil, and never receives.
+func retryTimer(queue *retry.Queue) (<-chan time.Time, func() bool) {
+	nextTry, ok := queue.NextTry()
+	if !ok {
+		return nil, func() bool { return false }
+	}
+	timer := time.NewTimer(time.Until(nextTry))
+	return timer.C, timer.Stop
+}
+
+// organiseFile moves a single file that has just arrived, even if it's waiting for a retry, and queues it if it can't
+// be moved yet. If fileName is a dir, the files already in it are organised instead when the run is recursive.
+// Duplicates among new files are only found by the next full scan.
+func organiseFile(
+	ctx context.Context, logger logging.Zerologger, downloads *organiser.Organiser, queue *retry.Queue, fileName string,
+) {
+	files, err := downloads.Entries(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Err(err).Str("file", fileName).Msg("unable to check new file")
+		}
+		return // moved or deleted again before we got to it
+	}
+	logger.Debug().Str("file", fileName).Msg("new file")
+	moveWithRetries(ctx, logger, downloads, files, queue)
+}